@@ -0,0 +1,115 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// accessLog writes one line per request handled by the server.
+type accessLog struct {
+	logger *log.Logger
+	// errorsOnly restricts the log to the requests with an error status,
+	// including the failures of the upstream server.
+	errorsOnly bool
+	// excludedPaths are the prefixes of the URL paths which are not logged.
+	excludedPaths []string
+	// geoIP, when set, appends the country code of the clients to the lines,
+	// or - when it is unknown.
+	geoIP bool
+	geoDB *geoIPDB
+}
+
+// newAccessLog appends the log to a file, or writes it to the standard output
+// when name is "-".
+func newAccessLog(name string, errorsOnly bool, excludedPaths []string) (*accessLog, error) {
+	var w io.Writer = os.Stdout
+	if name != "-" {
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, err
+		}
+		w = file
+	}
+	return &accessLog{logger: log.New(w, "", log.LstdFlags), errorsOnly: errorsOnly, excludedPaths: excludedPaths}, nil
+}
+
+func (accessLog *accessLog) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range accessLog.excludedPaths {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		start := time.Now()
+		rec := newResponseRecorder(w)
+		next.ServeHTTP(rec, r)
+		if accessLog.errorsOnly && rec.status < http.StatusBadRequest {
+			return
+		}
+		line := fmt.Sprintf("%s \"%s %s %s\" %d %d %s", r.RemoteAddr, r.Method, r.RequestURI, r.Proto, rec.status, rec.bytes, time.Since(start).Round(time.Millisecond))
+		if accessLog.geoIP {
+			line += " " + accessLog.country(r.RemoteAddr)
+		}
+		accessLog.logger.Print(line)
+	})
+}
+
+// country returns the country code of a client address, or - if it is
+// unknown.
+func (accessLog *accessLog) country(addr string) string {
+	if accessLog.geoDB == nil {
+		return "-"
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "-"
+	}
+	if code := accessLog.geoDB.country(ip); code != "" {
+		return code
+	}
+	return "-"
+}
+
+// logSlowRequests logs a warning for the requests handled by next which take
+// longer than threshold, independently of the access log.
+func logSlowRequests(threshold time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := newResponseRecorder(w)
+		next.ServeHTTP(rec, r)
+		if duration := time.Since(start); duration > threshold {
+			warnf("Slow request %s %s: %d in %s", r.Method, r.URL.Path, rec.status, duration.Round(time.Millisecond))
+		}
+	})
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type benchServeCommand struct {
+	options serverOptions
+	size    sizeValue
+	count   int
+	cli     *flag.FlagSet
+}
+
+func newBenchServeCommand() *benchServeCommand {
+	result := &benchServeCommand{size: 256 << 20}
+	result.cli = flag.NewFlagSet(result.Name(), flag.ExitOnError)
+	result.cli.Usage = func() {
+		fmt.Fprintf(result.cli.Output(), "Usage: %s %s [OPTIONS...] [FILE]\n", os.Args[0], result.Name())
+		result.cli.PrintDefaults()
+	}
+	result.options.registerFlags(result.cli)
+	result.cli.Var(&result.size, "size", "size of the file generated when no file is provided, with an optional K, M, G or T suffix")
+	result.cli.IntVar(&result.count, "count", 10, "number of downloads of the file")
+	return result
+}
+
+func (cmd *benchServeCommand) Name() string {
+	return "bench-serve"
+}
+
+func (cmd *benchServeCommand) Desc() string {
+	return "Measure the throughput of the server downloading a file over the loopback interface."
+}
+
+func (cmd *benchServeCommand) PrintUsage() {
+	cmd.cli.Usage()
+}
+
+// generateFile writes a file of random bytes, which cannot be compressed, in
+// a new temporary directory and returns its path.
+func generateFile(size int64) (string, error) {
+	dir, err := os.MkdirTemp("", "bench-serve")
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Join(dir, "bench.bin")
+	file, err := os.Create(name)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	_, err = io.CopyN(file, rand.New(rand.NewSource(1)), size)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return name, nil
+}
+
+// downloadSize fetches target and returns the number of bytes received.
+func downloadSize(client *http.Client, target string) (int64, error) {
+	resp, err := client.Get(target)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s: unexpected status %s", target, resp.Status)
+	}
+	return io.Copy(io.Discard, resp.Body)
+}
+
+func (cmd *benchServeCommand) Run(args []string) error {
+	cmd.cli.Parse(args)
+	if cmd.cli.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "Unknown argument", cmd.cli.Arg(1))
+		cmd.cli.SetOutput(os.Stderr)
+		cmd.cli.Usage()
+		os.Exit(1)
+	}
+	if cmd.count <= 0 {
+		return fmt.Errorf("Invalid download count %d", cmd.count)
+	}
+	name := cmd.cli.Arg(0)
+	if name == "" {
+		generated, err := generateFile(int64(cmd.size))
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(filepath.Dir(generated))
+		name = generated
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", name)
+	}
+	// The file is served by the frontend route, with the other options
+	opts := &cmd.options
+	opts.frontend = listValue{filepath.Dir(name)}
+	opts.frontendMode = routeLocal
+	opts.listenTLS = ""
+	server, err := newServer(opts)
+	if err != nil {
+		return err
+	}
+	listener, err := bind("127.0.0.1:0", opts)
+	if err != nil {
+		return err
+	}
+	go serve(server, []net.Listener{listener}, opts)
+	defer server.Close()
+
+	client := &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+	scheme := "http"
+	if server.TLSConfig != nil {
+		scheme = "https"
+		client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	target := fmt.Sprintf("%s://%s/frontend/%s", scheme, listener.Addr(), url.PathEscape(filepath.Base(name)))
+	var total int64
+	start := time.Now()
+	for i := 1; i <= cmd.count; i++ {
+		downloadStart := time.Now()
+		size, err := downloadSize(client, target)
+		if err != nil {
+			return err
+		}
+		elapsed := time.Since(downloadStart)
+		total += size
+		fmt.Printf("Download %d: %d bytes in %s, %.1f MB/s\n", i, size, elapsed.Round(time.Millisecond), throughput(size, elapsed))
+	}
+	elapsed := time.Since(start)
+	fmt.Printf("Total: %d bytes in %s, %.1f MB/s\n", total, elapsed.Round(time.Millisecond), throughput(total, elapsed))
+	return nil
+}
+
+// throughput returns the rate of size bytes transferred in elapsed, in MB/s.
+func throughput(size int64, elapsed time.Duration) float64 {
+	return float64(size) / 1e6 / elapsed.Seconds()
+}
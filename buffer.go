@@ -0,0 +1,74 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// copyBufferPool provides the buffers used to copy the response bodies. It
+// implements httputil.BufferPool.
+type copyBufferPool struct {
+	pool sync.Pool
+}
+
+func newCopyBufferPool(size int) *copyBufferPool {
+	return &copyBufferPool{pool: sync.Pool{New: func() any { return make([]byte, size) }}}
+}
+
+func (p *copyBufferPool) Get() []byte {
+	return p.pool.Get().([]byte)
+}
+
+func (p *copyBufferPool) Put(buf []byte) {
+	p.pool.Put(buf)
+}
+
+// writerOnly hides the optional interfaces of a writer, so that io.CopyBuffer
+// uses the provided buffer.
+type writerOnly struct {
+	io.Writer
+}
+
+// copyBufferWriter copies the bodies written with ReadFrom, as done by
+// http.ServeContent, with the buffers of a pool.
+type copyBufferWriter struct {
+	http.ResponseWriter
+	buffers *copyBufferPool
+}
+
+func (cw *copyBufferWriter) ReadFrom(src io.Reader) (int64, error) {
+	buf := cw.buffers.Get()
+	defer cw.buffers.Put(buf)
+	return io.CopyBuffer(writerOnly{cw.ResponseWriter}, src, buf)
+}
+
+func (cw *copyBufferWriter) Flush() {
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (cw *copyBufferWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,615 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cachedHeaders are the response headers stored along with a cached body.
+var cachedHeaders = []string{"Content-Type", "Etag", "Last-Modified"}
+
+// ensureDir creates a directory and its parents if it does not exist.
+func ensureDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return fmt.Errorf("Cannot create directory %s: %w", dir, err)
+	}
+	infof("Created directory %s", dir)
+	return nil
+}
+
+// checkWritable fails when files cannot be created in dir, for instance on a
+// read-only mount.
+func checkWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("Directory %s is not writable: %w", dir, err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// cacheIndexName is the name of the file of the cache directory where the
+// sizes and access times of the entries are persisted.
+const cacheIndexName string = "index.json"
+
+// diskCache stores the upstream responses in a directory. Each entry is made
+// of the body file and of a metadata file, both named after the key hash.
+// When maxSize is positive, the least recently used entries are evicted once
+// the total size of the bodies exceeds it.
+type diskCache struct {
+	dir     string
+	ttl     time.Duration
+	maxSize int64
+
+	mutex   sync.Mutex
+	entries map[string]*cacheEntry
+	size    int64
+	dirty   bool
+
+	// saveMutex serializes the index saves, so that an older snapshot never
+	// replaces a newer one.
+	saveMutex sync.Mutex
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+// cacheEntry is the index record of an entry, identified by its key hash.
+type cacheEntry struct {
+	Size     int64     `json:"size"`
+	Accessed time.Time `json:"accessed"`
+}
+
+// cacheMeta is the content of an entry metadata file.
+type cacheMeta struct {
+	Key    string      `json:"key"`
+	Header http.Header `json:"header"`
+	Stored time.Time   `json:"stored"`
+}
+
+func newDiskCache(dir string, ttl time.Duration, maxSize int64) (*diskCache, error) {
+	if err := ensureDir(dir); err != nil {
+		return nil, err
+	}
+	if err := checkWritable(dir); err != nil {
+		return nil, err
+	}
+	cache := &diskCache{dir: dir, ttl: ttl, maxSize: maxSize}
+	if err := cache.loadIndex(); err != nil {
+		return nil, err
+	}
+	cache.mutex.Lock()
+	cache.evict()
+	cache.mutex.Unlock()
+	go cache.saveIndexPeriodically(time.Minute)
+	return cache, nil
+}
+
+// cacheSet holds the proxy caches by route root. The cache of the empty root is
+// shared by all the routes.
+type cacheSet map[string]*diskCache
+
+// newCacheSet creates the proxy caches. With the cache-per-route option, each
+// route has its own cache in a subdirectory named after it.
+func newCacheSet(opts *serverOptions) (cacheSet, error) {
+	caches := cacheSet{}
+	if opts.cacheDir == "" {
+		return caches, nil
+	}
+	if !opts.cachePerRoute {
+		if opts.frontendCacheMax > 0 || opts.systemCacheMax > 0 || opts.romCacheMax > 0 {
+			return nil, fmt.Errorf("The per-route cache sizes require the cache-per-route option")
+		}
+		cache, err := newDiskCache(opts.cacheDir, opts.cacheTTL, int64(opts.cacheMaxSize))
+		if err != nil {
+			return nil, err
+		}
+		caches[""] = cache
+		return caches, nil
+	}
+	routes := []struct {
+		root    string
+		maxSize sizeValue
+	}{
+		{"/frontend/", opts.frontendCacheMax},
+		{"/system/", opts.systemCacheMax},
+		{"/cores/", opts.romCacheMax},
+	}
+	for _, route := range routes {
+		maxSize := route.maxSize
+		if maxSize == 0 {
+			maxSize = opts.cacheMaxSize
+		}
+		dir := filepath.Join(opts.cacheDir, strings.Trim(route.root, "/"))
+		cache, err := newDiskCache(dir, opts.cacheTTL, int64(maxSize))
+		if err != nil {
+			return nil, err
+		}
+		caches[route.root] = cache
+	}
+	return caches, nil
+}
+
+// stats returns the counters of the cache.
+func (cache *diskCache) stats(name string) cacheStats {
+	cache.mutex.Lock()
+	size := cache.size
+	cache.mutex.Unlock()
+	return cacheStats{Name: name, Hits: cache.hits.Load(), Misses: cache.misses.Load(), Evictions: cache.evictions.Load(), Size: size}
+}
+
+// saveIndexes saves the indexes of the caches which changed.
+func (caches cacheSet) saveIndexes() {
+	for _, cache := range caches {
+		if err := cache.saveIndex(); err != nil {
+			errorf("Could not save the cache index: %v", err)
+		}
+	}
+}
+
+// get returns the cache of a URL path, or nil if it is not cached.
+func (caches cacheSet) get(urlPath string) *diskCache {
+	for root, cache := range caches {
+		if root != "" && strings.HasPrefix(urlPath, root) {
+			return cache
+		}
+	}
+	return caches[""]
+}
+
+func (cache *diskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(cache.dir, name[:2], name)
+}
+
+// loadIndex reads the persisted index and reconciles it with the entries
+// actually present in the cache directory. The entries missing from the index
+// are considered accessed when their body was last modified.
+func (cache *diskCache) loadIndex() error {
+	persisted := map[string]*cacheEntry{}
+	data, err := os.ReadFile(filepath.Join(cache.dir, cacheIndexName))
+	if err == nil {
+		if err := json.Unmarshal(data, &persisted); err != nil {
+			warnf("Ignoring invalid cache index: %v", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	cache.entries = map[string]*cacheEntry{}
+	cache.size = 0
+	return filepath.WalkDir(cache.dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		base := d.Name()
+		if len(base) != sha256.Size*2 || strings.Contains(base, ".") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry := &cacheEntry{Size: info.Size(), Accessed: info.ModTime()}
+		if previous, ok := persisted[base]; ok {
+			entry.Accessed = previous.Accessed
+		}
+		cache.entries[base] = entry
+		cache.size += entry.Size
+		return nil
+	})
+}
+
+// saveIndex persists the index if it changed since it was last saved.
+func (cache *diskCache) saveIndex() error {
+	cache.saveMutex.Lock()
+	defer cache.saveMutex.Unlock()
+	cache.mutex.Lock()
+	if !cache.dirty {
+		cache.mutex.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(cache.entries)
+	cache.dirty = false
+	cache.mutex.Unlock()
+	if err == nil {
+		tmp := filepath.Join(cache.dir, cacheIndexName+".tmp")
+		if err = os.WriteFile(tmp, data, 0640); err == nil {
+			err = os.Rename(tmp, filepath.Join(cache.dir, cacheIndexName))
+		}
+	}
+	if err != nil {
+		// The next save retries
+		cache.mutex.Lock()
+		cache.dirty = true
+		cache.mutex.Unlock()
+	}
+	return err
+}
+
+func (cache *diskCache) saveIndexPeriodically(period time.Duration) {
+	for range time.Tick(period) {
+		if err := cache.saveIndex(); err != nil {
+			errorf("Could not save the cache index: %v", err)
+		}
+	}
+}
+
+// touch records an access to the entry stored at name.
+func (cache *diskCache) touch(name string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if entry, ok := cache.entries[filepath.Base(name)]; ok {
+		entry.Accessed = time.Now()
+		cache.dirty = true
+	}
+}
+
+// add records a new entry stored at name, then evicts the least recently used
+// entries if the cache is too large. The index is saved periodically and on
+// shutdown.
+func (cache *diskCache) add(name string, size int64) {
+	cache.mutex.Lock()
+	base := filepath.Base(name)
+	if previous, ok := cache.entries[base]; ok {
+		cache.size -= previous.Size
+	}
+	cache.entries[base] = &cacheEntry{Size: size, Accessed: time.Now()}
+	cache.size += size
+	cache.dirty = true
+	cache.evict()
+	cache.mutex.Unlock()
+}
+
+// evict removes the least recently used entries until the total size fits
+// in maxSize, if positive. The mutex must be held.
+func (cache *diskCache) evict() {
+	if cache.maxSize <= 0 || cache.size <= cache.maxSize {
+		return
+	}
+	names := make([]string, 0, len(cache.entries))
+	for name := range cache.entries {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return cache.entries[names[i]].Accessed.Before(cache.entries[names[j]].Accessed)
+	})
+	for _, name := range names {
+		if cache.size <= cache.maxSize {
+			break
+		}
+		body := filepath.Join(cache.dir, name[:2], name)
+		if err := os.Remove(body); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		os.Remove(body + ".meta")
+		cache.size -= cache.entries[name].Size
+		delete(cache.entries, name)
+		cache.dirty = true
+		cache.evictions.Add(1)
+	}
+}
+
+// lookup opens the entry of key, or returns fs.ErrNotExist. The entries older
+// than the TTL are only returned when stale is true.
+func (cache *diskCache) lookup(key string, stale bool) (*os.File, *cacheMeta, error) {
+	name := cache.path(key)
+	data, err := os.ReadFile(name + ".meta")
+	if err != nil {
+		return nil, nil, err
+	}
+	meta := &cacheMeta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, nil, err
+	}
+	if meta.Key != key || (!stale && time.Since(meta.Stored) > cache.ttl) {
+		return nil, nil, fs.ErrNotExist
+	}
+	body, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	cache.touch(name)
+	return body, meta, nil
+}
+
+// serve writes the cached response of key and tells whether it was found.
+func (cache *diskCache) serve(w http.ResponseWriter, r *http.Request, key string) bool {
+	body, meta, err := cache.lookup(key, false)
+	if err != nil {
+		cache.misses.Add(1)
+		return false
+	}
+	cache.hits.Add(1)
+	defer body.Close()
+	cache.write(w, r, body, meta)
+	return true
+}
+
+// serveStale writes the cached response of key even if it is older than the
+// TTL, with a Warning header when it is, and tells whether it was found. The
+// headers of the response which do not apply to the cached body are removed.
+func (cache *diskCache) serveStale(w http.ResponseWriter, r *http.Request, key string) bool {
+	body, meta, err := cache.lookup(key, true)
+	if err != nil {
+		return false
+	}
+	defer body.Close()
+	for _, header := range []string{"Content-Encoding", "Content-Length", "Content-Range", "Content-Type"} {
+		w.Header().Del(header)
+	}
+	if time.Since(meta.Stored) > cache.ttl {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+	cache.write(w, r, body, meta)
+	return true
+}
+
+// write writes a cached response.
+func (cache *diskCache) write(w http.ResponseWriter, r *http.Request, body *os.File, meta *cacheMeta) {
+	for _, header := range cachedHeaders {
+		if value := meta.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	modTime, _ := http.ParseTime(meta.Header.Get("Last-Modified"))
+	http.ServeContent(w, r, path.Base(r.URL.Path), modTime, body)
+}
+
+// store returns a reader of the response body which saves it in the cache
+// once it is completely read.
+func (cache *diskCache) store(key string, resp *http.Response) io.ReadCloser {
+	name := cache.path(key)
+	if err := os.MkdirAll(filepath.Dir(name), 0750); err != nil {
+		return resp.Body
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return resp.Body
+	}
+	meta := &cacheMeta{Key: key, Header: http.Header{}, Stored: time.Now()}
+	for _, header := range cachedHeaders {
+		if value := resp.Header.Get(header); value != "" {
+			meta.Header.Set(header, value)
+		}
+	}
+	return &cacheWriter{cache: cache, body: resp.Body, tmp: tmp, name: name, meta: meta, remaining: resp.ContentLength}
+}
+
+// cacheWriter copies a body to a temporary file while it is read, then moves
+// it in the cache when the end is reached.
+type cacheWriter struct {
+	cache     *diskCache
+	body      io.ReadCloser
+	tmp       *os.File
+	name      string
+	meta      *cacheMeta
+	remaining int64
+	written   int64
+	err       error
+}
+
+func (cw *cacheWriter) Read(p []byte) (int, error) {
+	n, err := cw.body.Read(p)
+	if cw.tmp != nil {
+		if n > 0 && cw.err == nil {
+			var written int
+			written, cw.err = cw.tmp.Write(p[:n])
+			cw.written += int64(written)
+		}
+		cw.remaining -= int64(n)
+		if err == io.EOF || cw.remaining == 0 {
+			cw.commit()
+		} else if err != nil {
+			cw.discard()
+		}
+	}
+	return n, err
+}
+
+func (cw *cacheWriter) commit() {
+	err := cw.err
+	if closeErr := cw.tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(cw.tmp.Name(), cw.name)
+	}
+	if err == nil {
+		err = writeFileAtomic(cw.name+".meta", cw.meta)
+	}
+	if err != nil {
+		os.Remove(cw.tmp.Name())
+	} else {
+		cw.cache.add(cw.name, cw.written)
+	}
+	cw.tmp = nil
+}
+
+// writeFileAtomic stores the JSON encoding of value in a file, replacing it
+// atomically.
+func writeFileAtomic(name string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func (cw *cacheWriter) discard() {
+	cw.tmp.Close()
+	os.Remove(cw.tmp.Name())
+	cw.tmp = nil
+}
+
+func (cw *cacheWriter) Close() error {
+	if cw.tmp != nil {
+		cw.discard()
+	}
+	return cw.body.Close()
+}
+
+// flush removes the entries whose key starts with prefix, and returns the
+// number of removed entries and their total size.
+func (cache *diskCache) flush(prefix string) (int, int64, error) {
+	count := 0
+	var size int64
+	err := filepath.WalkDir(cache.dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(name, ".meta") {
+			return err
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil
+		}
+		meta := &cacheMeta{}
+		if json.Unmarshal(data, meta) != nil || !strings.HasPrefix(meta.Key, prefix) {
+			return nil
+		}
+		body := strings.TrimSuffix(name, ".meta")
+		info, err := os.Stat(body)
+		if err == nil {
+			if err := os.Remove(body); err != nil {
+				return err
+			}
+		}
+		os.Remove(name)
+		count++
+		if info != nil {
+			size += info.Size()
+		}
+		cache.mutex.Lock()
+		if entry, ok := cache.entries[filepath.Base(body)]; ok {
+			cache.size -= entry.Size
+			delete(cache.entries, filepath.Base(body))
+			cache.dirty = true
+		}
+		cache.mutex.Unlock()
+		return nil
+	})
+	if err != nil {
+		return count, size, err
+	}
+	return count, size, cache.saveIndex()
+}
+
+// repairReport is the result of the repair of a cache directory.
+type repairReport struct {
+	Entries int
+	Size    int64
+	Removed int
+}
+
+// repair removes the incomplete entries of the cache, left by an unclean
+// shutdown, and rebuilds its index from the remaining ones: the temporary
+// files, the bodies without a valid metadata file and the metadata files
+// without a body are removed. The server must not use the cache meanwhile.
+func (cache *diskCache) repair() (repairReport, error) {
+	report := repairReport{}
+	remove := func(name string) error {
+		if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		debugf("Removed %s", name)
+		report.Removed++
+		return nil
+	}
+	dirs := []string{}
+	err := filepath.WalkDir(cache.dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if name != cache.dir {
+				dirs = append(dirs, name)
+			}
+			return nil
+		}
+		base := d.Name()
+		if strings.HasPrefix(base, ".tmp-") || strings.HasSuffix(base, ".tmp") {
+			return remove(name)
+		}
+		if len(base) == sha256.Size*2 && !strings.Contains(base, ".") && !cache.validEntry(name) {
+			return remove(name)
+		}
+		if strings.HasSuffix(base, ".meta") {
+			if _, err := os.Stat(strings.TrimSuffix(name, ".meta")); errors.Is(err, fs.ErrNotExist) {
+				return remove(name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	for _, dir := range dirs {
+		// Only the emptied directories are removed
+		os.Remove(dir)
+	}
+	if err := cache.loadIndex(); err != nil {
+		return report, err
+	}
+	cache.dirty = true
+	report.Entries, report.Size = len(cache.entries), cache.size
+	return report, cache.saveIndex()
+}
+
+// validEntry tells whether the body stored at name has a metadata file whose
+// key matches it.
+func (cache *diskCache) validEntry(name string) bool {
+	data, err := os.ReadFile(name + ".meta")
+	if err != nil {
+		return false
+	}
+	meta := &cacheMeta{}
+	return json.Unmarshal(data, meta) == nil && cache.path(meta.Key) == name
+}
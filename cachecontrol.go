@@ -0,0 +1,128 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheControlRule is the Cache-Control header of the files with an
+// extension.
+type cacheControlRule struct {
+	value string
+	// maxAge is the max-age directive of value, from which the Expires
+	// header is computed, or -1 without one.
+	maxAge time.Duration
+}
+
+// parseCacheControlRules parses EXT=DIRECTIVES rules, such as
+// .zip=max-age=31536000,immutable, by lowercase extension.
+func parseCacheControlRules(values []string) (map[string]cacheControlRule, error) {
+	result := map[string]cacheControlRule{}
+	for _, value := range values {
+		ext, directives, found := strings.Cut(value, "=")
+		if !found || !strings.HasPrefix(ext, ".") || len(ext) < 2 || strings.TrimSpace(directives) == "" {
+			return nil, fmt.Errorf("Invalid cache control rule %s: expected .EXT=DIRECTIVES", value)
+		}
+		rule := cacheControlRule{value: strings.TrimSpace(directives), maxAge: -1}
+		for _, directive := range strings.Split(rule.value, ",") {
+			name, seconds, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if strings.ToLower(name) != "max-age" {
+				continue
+			}
+			n, err := strconv.ParseInt(seconds, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("Invalid cache control rule %s: invalid max-age %s", value, seconds)
+			}
+			rule.maxAge = time.Duration(n) * time.Second
+		}
+		result[strings.ToLower(ext)] = rule
+	}
+	return result, nil
+}
+
+// cacheControlWriter sets the caching headers of a successful response.
+type cacheControlWriter struct {
+	http.ResponseWriter
+	rule        cacheControlRule
+	wroteHeader bool
+}
+
+func (cw *cacheControlWriter) WriteHeader(status int) {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		if status == http.StatusOK || status == http.StatusPartialContent || status == http.StatusNotModified {
+			cw.ResponseWriter.Header().Set("Cache-Control", cw.rule.value)
+			if cw.rule.maxAge >= 0 {
+				cw.ResponseWriter.Header().Set("Expires", time.Now().Add(cw.rule.maxAge).UTC().Format(http.TimeFormat))
+			} else {
+				cw.ResponseWriter.Header().Del("Expires")
+			}
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *cacheControlWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// ReadFrom keeps the sendfile optimization of the wrapped writer.
+func (cw *cacheControlWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if rf, ok := cw.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(cw.ResponseWriter, r)
+}
+
+func (cw *cacheControlWriter) Flush() {
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (cw *cacheControlWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// cacheControl sets the Cache-Control and Expires headers of the successful
+// responses to the requests of the files whose extension has a rule, replacing
+// the ones of the upstream server or of the index files.
+func cacheControl(rules map[string]cacheControlRule, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rule, ok := rules[strings.ToLower(path.Ext(r.URL.Path))]; ok {
+			w = &cacheControlWriter{ResponseWriter: w, rule: rule}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,277 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// casPrefix starts the locations of content-addressed stores.
+const casPrefix string = "cas:"
+
+// isCASLocation tells whether a source location is a content-addressed store.
+func isCASLocation(location string) bool {
+	return strings.HasPrefix(location, casPrefix)
+}
+
+// casSource serves the files of a content-addressed store. Its mapping file
+// has one HASH NAME line per file, in the format of the sha256sum output, and
+// the content of a file is the blob named after its hash in the directory of
+// the mapping, or in its subdirectory named after the first two characters of
+// the hash. The mapping is loaded again when it is modified.
+type casSource struct {
+	mapping string
+	blobs   string
+	mutex   sync.Mutex
+	modTime time.Time
+	tree    *casTree
+}
+
+// casTree is the content of a mapping: the hash of each file and the sorted
+// entries of each directory, by absolute slash-separated paths.
+type casTree struct {
+	modTime time.Time
+	files   map[string]string
+	dirs    map[string][]string
+}
+
+func newCASSource(location string) (*casSource, error) {
+	mapping := strings.TrimPrefix(location, casPrefix)
+	if mapping == "" {
+		return nil, fmt.Errorf("Missing mapping file in %s", location)
+	}
+	result := &casSource{mapping: mapping, blobs: filepath.Dir(mapping)}
+	if _, err := result.load(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// parseCASMapping reads the lines of a mapping file.
+func parseCASMapping(r io.Reader, modTime time.Time) (*casTree, error) {
+	tree := &casTree{modTime: modTime, files: map[string]string{}, dirs: map[string][]string{"/": nil}}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		hash, name, found := strings.Cut(text, " ")
+		// The binary mode marker of sha256sum is part of the separator
+		name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+		name = path.Clean("/" + name)
+		if !found || hash == "" || strings.ContainsAny(hash, `/\.`) || name == "/" {
+			return nil, fmt.Errorf("Line %d: expected HASH NAME", line)
+		}
+		if _, exists := tree.dirs[name]; exists {
+			return nil, fmt.Errorf("Line %d: %s is a directory", line, name)
+		}
+		if _, exists := tree.files[name]; !exists {
+			// Add the entry to its parent directories, created if missing
+			for child, dir := name, path.Dir(name); ; child, dir = dir, path.Dir(dir) {
+				if _, exists := tree.files[dir]; exists {
+					return nil, fmt.Errorf("Line %d: %s is a file", line, dir)
+				}
+				entries, exists := tree.dirs[dir]
+				tree.dirs[dir] = append(entries, path.Base(child))
+				if exists {
+					break
+				}
+			}
+		}
+		tree.files[name] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, entries := range tree.dirs {
+		sort.Strings(entries)
+	}
+	return tree, nil
+}
+
+// load returns the tree of the mapping, parsed again if it was modified.
+func (source *casSource) load() (*casTree, error) {
+	info, err := os.Stat(source.mapping)
+	if err != nil {
+		return nil, err
+	}
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	if source.tree != nil && info.ModTime().Equal(source.modTime) {
+		return source.tree, nil
+	}
+	file, err := os.Open(source.mapping)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	tree, err := parseCASMapping(file, info.ModTime())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source.mapping, err)
+	}
+	source.tree, source.modTime = tree, info.ModTime()
+	return tree, nil
+}
+
+// blob opens the blob of a hash.
+func (source *casSource) blob(hash string) (*os.File, error) {
+	if len(hash) > 2 {
+		file, err := os.Open(filepath.Join(source.blobs, hash[:2], hash))
+		if err == nil || !os.IsNotExist(err) {
+			return file, err
+		}
+	}
+	return os.Open(filepath.Join(source.blobs, hash))
+}
+
+func (source *casSource) Open(name string) (http.File, error) {
+	tree, err := source.load()
+	if err != nil {
+		return nil, err
+	}
+	name = path.Clean("/" + name)
+	if hash, ok := tree.files[name]; ok {
+		file, err := source.blob(hash)
+		if err != nil {
+			return nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &casFile{File: file, info: casEntry{info, path.Base(name)}}, nil
+	}
+	if entries, ok := tree.dirs[name]; ok {
+		return &casDir{source: source, tree: tree, name: name, entries: entries}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// casEntry is the description of a blob under its logical name.
+type casEntry struct {
+	fs.FileInfo
+	name string
+}
+
+func (e casEntry) Name() string {
+	return e.name
+}
+
+// casFile is an opened file of a content-addressed store.
+type casFile struct {
+	*os.File
+	info casEntry
+}
+
+func (f *casFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// casDir is an opened directory of a content-addressed store. Its modification
+// time is the one of the mapping.
+type casDir struct {
+	source  *casSource
+	tree    *casTree
+	name    string
+	entries []string
+}
+
+func (d *casDir) Name() string {
+	return path.Base(d.name)
+}
+
+func (d *casDir) Size() int64 {
+	return 0
+}
+
+func (d *casDir) Mode() fs.FileMode {
+	return fs.ModeDir | 0555
+}
+
+func (d *casDir) ModTime() time.Time {
+	return d.tree.modTime
+}
+
+func (d *casDir) IsDir() bool {
+	return true
+}
+
+func (d *casDir) Sys() any {
+	return nil
+}
+
+func (d *casDir) Stat() (fs.FileInfo, error) {
+	return d, nil
+}
+
+func (d *casDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *casDir) Seek(int64, int) (int64, error) {
+	return 0, &fs.PathError{Op: "seek", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *casDir) Close() error {
+	return nil
+}
+
+// Readdir describes the entries with their blobs. The files whose blob is
+// missing are skipped rather than failing the whole listing.
+func (d *casDir) Readdir(count int) ([]fs.FileInfo, error) {
+	if count > 0 && len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	result := []fs.FileInfo{}
+	for len(d.entries) > 0 && (count <= 0 || len(result) < count) {
+		name := path.Join(d.name, d.entries[0])
+		d.entries = d.entries[1:]
+		if _, ok := d.tree.dirs[name]; ok {
+			result = append(result, &casDir{source: d.source, tree: d.tree, name: name})
+			continue
+		}
+		file, err := d.source.blob(d.tree.files[name])
+		if err != nil {
+			continue
+		}
+		info, err := file.Stat()
+		file.Close()
+		if err == nil {
+			result = append(result, casEntry{info, path.Base(name)})
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type checkConfigCommand struct {
+	cli *flag.FlagSet
+}
+
+func newCheckConfigCommand() *checkConfigCommand {
+	result := &checkConfigCommand{}
+	result.cli = flag.NewFlagSet(result.Name(), flag.ExitOnError)
+	result.cli.Usage = func() {
+		fmt.Fprintf(result.cli.Output(), "Usage: %s %s PATH\n", os.Args[0], result.Name())
+		result.cli.PrintDefaults()
+	}
+	return result
+}
+
+func (cmd *checkConfigCommand) Name() string {
+	return "check-config"
+}
+
+func (cmd *checkConfigCommand) Desc() string {
+	return "Check a configuration file or directory without starting the server."
+}
+
+func (cmd *checkConfigCommand) PrintUsage() {
+	cmd.cli.Usage()
+}
+
+// checkLocations returns the problems of the locations of the routes and of
+// their user agent rules: an invalid order or mode, or a missing local
+// directory or mapping file.
+func checkLocations(opts *serverOptions) []error {
+	problems := []error{}
+	routes := []struct {
+		option    string
+		locations []string
+		mode      string
+		agents    []string
+	}{
+		{"frontend", opts.frontend, opts.frontendMode, opts.frontendAgents},
+		{"system", opts.system, opts.systemMode, opts.systemAgents},
+		{"rom", opts.rom, opts.romMode, opts.romAgents},
+	}
+	for _, route := range routes {
+		if route.mode == routeDisabled || route.mode == routeProxy {
+			continue
+		}
+		// The invalid rules are reported by validateOptions
+		rules, _ := parseUserAgentRules(route.agents)
+		problems = append(problems, checkRouteLocations(route.option, route.locations, route.mode)...)
+		for _, rule := range rules {
+			problems = append(problems, checkRouteLocations(route.option+"-user-agent", rule.locations, route.mode)...)
+		}
+	}
+	return problems
+}
+
+// checkRouteLocations returns the problems of the locations of a route set by
+// option.
+func checkRouteLocations(option string, locations []string, mode string) []error {
+	problems := []error{}
+	locations, err := routeLocations(locations, mode)
+	if err == nil {
+		_, _, err = newChainSource(locations, false, nil)
+	}
+	if err != nil {
+		return append(problems, fmt.Errorf("Option %s: %w", option, err))
+	}
+	for _, location := range locations {
+		if location == "" || location == upstreamLocation || isRemoteLocation(location) || isCASLocation(location) {
+			continue
+		}
+		if info, err := os.Stat(location); err != nil {
+			problems = append(problems, fmt.Errorf("Option %s: %w", option, err))
+		} else if !info.IsDir() {
+			problems = append(problems, fmt.Errorf("Option %s: %s is not a directory", option, location))
+		}
+	}
+	return problems
+}
+
+// checkFiles returns the problems of the options naming a file which must
+// exist, including the upstream headers read from a file.
+func checkFiles(opts *serverOptions) []error {
+	problems := []error{}
+	files := map[string]string{
+		"tls-cert":       opts.tlsCert,
+		"tls-key":        opts.tlsKey,
+		"mime-file":      opts.mimeFile,
+		"index-template": opts.indexTemplate,
+		"geoip-db":       opts.geoIPDB,
+	}
+	for _, page := range opts.errorPages {
+		_, name, _ := strings.Cut(page, "=")
+		files["error-page "+page] = name
+	}
+	options := make([]string, 0, len(files))
+	for option := range files {
+		options = append(options, option)
+	}
+	sort.Strings(options)
+	for _, option := range options {
+		if files[option] == "" {
+			continue
+		}
+		if _, err := os.Stat(files[option]); err != nil {
+			problems = append(problems, fmt.Errorf("Option %s: %w", option, err))
+		}
+	}
+	headers := []struct {
+		option string
+		values []string
+	}{
+		{"frontend-upstream-header", opts.frontendHeaders},
+		{"system-upstream-header", opts.systemHeaders},
+		{"rom-upstream-header", opts.romHeaders},
+	}
+	for _, header := range headers {
+		if _, err := parseUpstreamHeaders("", header.values); err != nil {
+			problems = append(problems, fmt.Errorf("Option %s: %w", header.option, err))
+		}
+	}
+	return problems
+}
+
+// checkListen returns the problems of the listening address, such as a missing
+// interface.
+func checkListen(opts *serverOptions) []error {
+	problems := []error{}
+	if _, err := listenAddresses(opts, opts.listen); err != nil {
+		problems = append(problems, fmt.Errorf("Option listen: %w", err))
+	}
+	return problems
+}
+
+func (cmd *checkConfigCommand) Run(args []string) error {
+	cmd.cli.Parse(args)
+	if cmd.cli.NArg() != 1 {
+		cmd.cli.SetOutput(os.Stderr)
+		cmd.cli.Usage()
+		os.Exit(1)
+	}
+	name := cmd.cli.Arg(0)
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	files := []string{name}
+	if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(name, "*.conf")); err != nil {
+			return err
+		}
+		sort.Strings(files)
+	}
+	opts := &serverOptions{listen: defaultListen}
+	cli := flag.NewFlagSet("serve", flag.ContinueOnError)
+	cli.SetOutput(io.Discard)
+	opts.registerFlags(cli)
+	problems := []error{}
+	for _, file := range files {
+		problems = append(problems, applyConfigFile(cli, file, true)...)
+	}
+	problems = append(problems, validateOptions(opts)...)
+	problems = append(problems, checkListen(opts)...)
+	problems = append(problems, checkLocations(opts)...)
+	problems = append(problems, checkFiles(opts)...)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found in %s", len(problems), name)
+	}
+	fmt.Printf("%s: valid configuration\n", name)
+	return nil
+}
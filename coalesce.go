@@ -0,0 +1,163 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"sync"
+)
+
+// coalesceChunkSize is the size of the chunks read from a coalesced file.
+const coalesceChunkSize int = 32 * 1024
+
+// readFlight is a file being read once for several requests. Its content grows
+// as it is read.
+type readFlight struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	data  []byte
+	done  bool
+	err   error
+}
+
+// readCoalescer reads only once the files requested concurrently. The files
+// larger than maxSize are not coalesced, as their content is kept in memory
+// while they are read.
+type readCoalescer struct {
+	maxSize int64
+	mutex   sync.Mutex
+	flights map[string]*readFlight
+}
+
+func newReadCoalescer(maxSize int64) *readCoalescer {
+	return &readCoalescer{maxSize: maxSize, flights: map[string]*readFlight{}}
+}
+
+// reader returns a reader of the content of file, joining the current read of
+// the same file if any. The file is closed once it is not needed anymore.
+func (coalescer *readCoalescer) reader(name string, file http.File, info fs.FileInfo) io.ReadSeeker {
+	key := fmt.Sprintf("%s\x00%d\x00%d", name, info.ModTime().UnixNano(), info.Size())
+	coalescer.mutex.Lock()
+	flight, found := coalescer.flights[key]
+	if !found {
+		flight = &readFlight{data: make([]byte, 0, info.Size())}
+		flight.cond = sync.NewCond(&flight.mutex)
+		coalescer.flights[key] = flight
+	}
+	coalescer.mutex.Unlock()
+	if found {
+		file.Close()
+	} else {
+		go func() {
+			flight.read(file)
+			file.Close()
+			coalescer.mutex.Lock()
+			delete(coalescer.flights, key)
+			coalescer.mutex.Unlock()
+		}()
+	}
+	return &flightReader{flight: flight, size: info.Size()}
+}
+
+// read reads the content of file in the flight, waking up the readers after
+// each chunk.
+func (flight *readFlight) read(file io.Reader) {
+	chunk := make([]byte, coalesceChunkSize)
+	for {
+		n, err := file.Read(chunk)
+		flight.mutex.Lock()
+		flight.data = append(flight.data, chunk[:n]...)
+		if err != nil {
+			flight.done = true
+			if err != io.EOF {
+				flight.err = err
+			}
+		}
+		flight.cond.Broadcast()
+		flight.mutex.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// flightReader reads the content of a flight, waiting for it to be read from
+// the file when needed.
+type flightReader struct {
+	flight *readFlight
+	size   int64
+	offset int64
+}
+
+func (r *flightReader) Read(p []byte) (int, error) {
+	flight := r.flight
+	flight.mutex.Lock()
+	defer flight.mutex.Unlock()
+	for int64(len(flight.data)) <= r.offset && !flight.done {
+		flight.cond.Wait()
+	}
+	if int64(len(flight.data)) <= r.offset {
+		if flight.err != nil {
+			return 0, flight.err
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, flight.data[r.offset:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *flightReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// serveCoalesced serves a complete GET request of a file with the coalescer,
+// and tells whether it was served.
+func (filesystem *fileSystem) serveCoalesced(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get("Range") != "" {
+		return false
+	}
+	file, err := filesystem.Open(r.URL.Path)
+	if err != nil {
+		return false
+	}
+	info, err := file.Stat()
+	_, generated := file.(inMemoryFile)
+	if err != nil || generated || !info.Mode().IsRegular() || info.Size() > filesystem.Coalescer.maxSize {
+		file.Close()
+		return false
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), filesystem.Coalescer.reader(r.URL.Path, file, info))
+	return true
+}
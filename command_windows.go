@@ -24,10 +24,10 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"net"
-	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/sys/windows/svc"
@@ -36,7 +36,9 @@ import (
 )
 
 const (
-	serviceName string = "retroarch-asset-server"
+	serviceName         string = "retroarch-asset-server"
+	serviceDisplayName  string = "Retroarch asset server"
+	eventSourceAttempts int    = 3
 )
 
 type windowsService struct {
@@ -59,19 +61,50 @@ func (ws *windowsService) Execute(args []string, r <-chan svc.ChangeRequest, s c
 		s <- svc.Status{State: svc.Stopped}
 		return true, 1
 	}
-	if argsHelper.listen == "" {
-		argsHelper.listen = defaultListen
+	opts := &argsHelper.options
+	if opts.listen == "" {
+		opts.listen = defaultListen
 	}
 
-	ws.elog.Info(1, fmt.Sprintf("Listening on %s", argsHelper.listen))
-	ws.elog.Info(1, fmt.Sprintf("Frontend path: %s", argsHelper.frontend))
-	ws.elog.Info(1, fmt.Sprintf("System path: %s", argsHelper.system))
-	ws.elog.Info(1, fmt.Sprintf("ROM path: %s", argsHelper.rom))
-	server := newServer(argsHelper.listen, argsHelper.frontend, argsHelper.system, argsHelper.rom)
+	ws.elog.Info(1, fmt.Sprintf("Frontend path: %s", opts.frontend))
+	ws.elog.Info(1, fmt.Sprintf("System path: %s", opts.system))
+	ws.elog.Info(1, fmt.Sprintf("ROM path: %s", opts.rom))
+	server, err := newServer(opts)
+	if err != nil {
+		ws.elog.Error(1, fmt.Sprintf("Invalid options: %s", err.Error()))
+		s <- svc.Status{State: svc.Stopped}
+		return true, 1
+	}
+	if opts.effectiveConfig != "" {
+		if err := writeEffectiveConfig(argsHelper.cli, opts.effectiveConfig); err != nil {
+			ws.elog.Warning(1, fmt.Sprintf("Could not write the effective configuration: %s", err.Error()))
+		}
+	}
+	if err := warmup(opts); err != nil {
+		ws.elog.Warning(1, fmt.Sprintf("Warmup incomplete: %s", err.Error()))
+	}
+	listeners, err := listen(opts)
+	if err != nil {
+		ws.elog.Error(1, fmt.Sprintf("HTTP server error: %s", err.Error()))
+		s <- svc.Status{State: svc.Stopped}
+		return true, 1
+	}
+	for _, listener := range listeners {
+		ws.elog.Info(1, fmt.Sprintf("Listening on %s", listener.Addr()))
+	}
+	if opts.advertise {
+		ad, err := advertise(listeners)
+		if err != nil {
+			ws.elog.Warning(1, fmt.Sprintf("Advertisement failed: %s", err.Error()))
+		} else {
+			defer ad.Close()
+			defer ad.withdraw()
+		}
+	}
 	ctxt, cancel := context.WithCancel(context.Background())
 	go func() {
-		err := server.ListenAndServe()
-		if err != nil && (err != http.ErrServerClosed) {
+		err := serve(server, listeners, opts)
+		if err != nil {
 			ws.elog.Error(1, fmt.Sprintf("HTTP server error: %s", err.Error()))
 		}
 		cancel()
@@ -86,8 +119,11 @@ loop:
 			case svc.Interrogate:
 				s <- c.CurrentStatus
 			case svc.Stop, svc.Shutdown:
-				server.Shutdown(context.Background())
-				s <- svc.Status{State: svc.StopPending}
+				s <- svc.Status{State: svc.StopPending, WaitHint: uint32((opts.drainPeriod + opts.shutdownTimeout) / time.Millisecond)}
+				drain(server, opts.drainPeriod)
+				if err := shutdown(server, opts.shutdownTimeout); err != nil {
+					ws.elog.Warning(1, fmt.Sprintf("Requests interrupted: %s", err.Error()))
+				}
 			default:
 				ws.elog.Error(1, fmt.Sprintf("unexpected control request #%d", c))
 			}
@@ -100,11 +136,9 @@ loop:
 }
 
 type registerSvcCommand struct {
-	listen   string
-	frontend string
-	system   string
-	rom      string
-	cli      *flag.FlagSet
+	options serverOptions
+	dryRun  bool
+	cli     *flag.FlagSet
 }
 
 func newRegisterSvcCommand(exitOnArgError bool) *registerSvcCommand {
@@ -114,16 +148,8 @@ func newRegisterSvcCommand(exitOnArgError bool) *registerSvcCommand {
 	} else {
 		result.cli = flag.NewFlagSet(result.Name(), flag.ContinueOnError)
 	}
-	result.cli.Func("listen", "Server listening address (default: "+defaultListen+")", func(s string) error {
-		endPoint, err := net.ResolveTCPAddr("tcp", s)
-		if err == nil {
-			result.listen = endPoint.String()
-		}
-		return err
-	})
-	result.cli.StringVar(&result.frontend, "frontend", "", "path of the directory where frontend is stored (optional)")
-	result.cli.StringVar(&result.system, "system", "", "path of the directory where systems are stored (optional)")
-	result.cli.StringVar(&result.rom, "rom", "", "path of the directory where ROMs are stored (optional)")
+	result.options.registerFlags(result.cli)
+	result.cli.BoolVar(&result.dryRun, "dry-run", false, "print the definition of the service without registering it")
 	return result
 }
 
@@ -139,6 +165,84 @@ func (cmd *registerSvcCommand) PrintUsage() {
 	cmd.cli.Usage()
 }
 
+// absLocation returns the absolute path of a local location.
+func absLocation(location string) (string, error) {
+	if isCASLocation(location) {
+		location, err := filepath.Abs(strings.TrimPrefix(location, casPrefix))
+		return casPrefix + location, err
+	}
+	if location == upstreamLocation || isRemoteLocation(location) {
+		return location, nil
+	}
+	return filepath.Abs(location)
+}
+
+// serviceArgs returns the command line options to store in the service
+// configuration. Paths are made absolute since the service does not run from
+// the current directory.
+func (cmd *registerSvcCommand) serviceArgs() ([]string, error) {
+	svcArgs := []string{}
+	var err error
+	cmd.cli.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		if list, ok := f.Value.(*listValue); ok {
+			for _, value := range *list {
+				switch f.Name {
+				case "frontend", "system", "rom":
+					if len(value) == 0 {
+						continue
+					}
+					value, err = absLocation(value)
+				case "frontend-user-agent", "system-user-agent", "rom-user-agent":
+					if i := strings.LastIndex(value, "="); i >= 0 {
+						var location string
+						location, err = absLocation(value[i+1:])
+						value = value[:i+1] + location
+					}
+				case "frontend-upstream-header", "system-upstream-header", "rom-upstream-header":
+					if name, content, _ := strings.Cut(value, ":"); strings.HasPrefix(strings.TrimSpace(content), "@") {
+						content, err = filepath.Abs(strings.TrimPrefix(strings.TrimSpace(content), "@"))
+						value = name + ": @" + content
+					}
+				case "error-page":
+					code, name, _ := strings.Cut(value, "=")
+					name, err = filepath.Abs(name)
+					value = code + "=" + name
+				}
+				if err != nil {
+					return
+				}
+				svcArgs = append(svcArgs, "-"+f.Name, value)
+			}
+			return
+		}
+		value := f.Value.String()
+		switch f.Name {
+		case "config-dir":
+			// The options of the files are already visited
+			return
+		case "dry-run":
+			return
+		case "listen":
+			value = cmd.options.listen
+		case "access-log":
+			if len(value) == 0 || value == "-" {
+				break
+			}
+			value, err = filepath.Abs(value)
+		case "mime-file", "cache-dir", "tls-cert", "tls-key", "index-template", "geoip-db", "write-effective-config":
+			if len(value) == 0 {
+				return
+			}
+			value, err = filepath.Abs(value)
+		}
+		svcArgs = append(svcArgs, "-"+f.Name, value)
+	})
+	return svcArgs, err
+}
+
 func (cmd *registerSvcCommand) Run(args []string) error {
 	cmd.cli.Parse(args)
 	if cmd.cli.NArg() > 0 {
@@ -148,58 +252,50 @@ func (cmd *registerSvcCommand) Run(args []string) error {
 		os.Exit(1)
 	}
 
-	manager, err := mgr.Connect()
+	exepath, err := filepath.Abs(os.Args[0])
 	if err != nil {
 		return err
 	}
-	defer manager.Disconnect()
-	if svc, err := manager.OpenService(serviceName); err == nil {
-		svc.Close()
-		return fmt.Errorf("Service %s already exists", serviceName)
+	if filepath.Ext(exepath) == "" {
+		exepath += ".exe"
 	}
-	exepath, err := filepath.Abs(os.Args[0])
+	svcArgs, err := cmd.serviceArgs()
 	if err != nil {
 		return err
 	}
-	if filepath.Ext(exepath) == "" {
-		exepath += ".exe"
+	if cmd.dryRun {
+		printServiceDefinition(exepath, svcArgs)
+		return nil
 	}
 
-	conf := mgr.Config{
-		DisplayName: "Retroarch asset server",
-		StartType:   mgr.StartAutomatic,
-	}
-	svcArgs := []string{}
-	if len(cmd.listen) > 0 {
-		svcArgs = append(svcArgs, "-listen", cmd.listen)
+	manager, err := mgr.Connect()
+	if err != nil {
+		return err
 	}
-	if len(cmd.frontend) > 0 {
-		cmd.frontend, err = filepath.Abs(cmd.frontend)
+	defer manager.Disconnect()
+
+	var service *mgr.Service
+	if existing, err := manager.OpenService(serviceName); err == nil {
+		// A previous registration may have been interrupted before the
+		// service was started: reuse the service unless it is running.
+		service = existing
+		defer service.Close()
+		err = updateStoppedService(service, exepath, svcArgs)
 		if err != nil {
 			return err
 		}
-		svcArgs = append(svcArgs, "-frontend", cmd.frontend)
-	}
-	if len(cmd.system) > 0 {
-		cmd.system, err = filepath.Abs(cmd.system)
-		if err != nil {
-			return err
+	} else {
+		conf := mgr.Config{
+			DisplayName: serviceDisplayName,
+			StartType:   mgr.StartAutomatic,
 		}
-		svcArgs = append(svcArgs, "-system", cmd.system)
-	}
-	if len(cmd.rom) > 0 {
-		cmd.rom, err = filepath.Abs(cmd.rom)
+		service, err = manager.CreateService(serviceName, exepath, conf, svcArgs...)
 		if err != nil {
 			return err
 		}
-		svcArgs = append(svcArgs, "-rom", cmd.rom)
-	}
-	service, err := manager.CreateService(serviceName, exepath, conf, svcArgs...)
-	if err != nil {
-		return err
+		defer service.Close()
 	}
-	defer service.Close()
-	err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	err = installEventSource()
 	if err != nil {
 		service.Delete()
 		return err
@@ -213,6 +309,66 @@ func (cmd *registerSvcCommand) Run(args []string) error {
 	return nil
 }
 
+// printServiceDefinition prints the configuration of the service which would
+// be registered.
+func printServiceDefinition(exepath string, args []string) {
+	commandLine := syscall.EscapeArg(exepath)
+	for _, arg := range args {
+		commandLine += " " + syscall.EscapeArg(arg)
+	}
+	fmt.Println("Service name:", serviceName)
+	fmt.Println("Display name:", serviceDisplayName)
+	fmt.Println("Start type: automatic")
+	fmt.Println("Executable:", exepath)
+	fmt.Println("Arguments:")
+	for i := 0; i < len(args); i += 2 {
+		fmt.Println(" ", strings.Join(args[i:i+2], " "))
+	}
+	fmt.Println("Command line:", commandLine)
+	fmt.Println("Event log source:", serviceName)
+}
+
+// updateStoppedService replaces the command line and the configuration of an
+// existing service, which must be stopped.
+func updateStoppedService(service *mgr.Service, exepath string, args []string) error {
+	status, err := service.Query()
+	if err != nil {
+		return err
+	}
+	if status.State != svc.Stopped {
+		return fmt.Errorf("Service %s already exists and is running", serviceName)
+	}
+	conf, err := service.Config()
+	if err != nil {
+		return err
+	}
+	conf.BinaryPathName = syscall.EscapeArg(exepath)
+	for _, arg := range args {
+		conf.BinaryPathName += " " + syscall.EscapeArg(arg)
+	}
+	conf.DisplayName = serviceDisplayName
+	conf.StartType = mgr.StartAutomatic
+	return service.UpdateConfig(conf)
+}
+
+// installEventSource registers the service as an event log source. An event
+// source left by a failed registration is replaced, and the installation is
+// retried since the registry may be transiently unavailable.
+func installEventSource() error {
+	var err error
+	for attempt := 0; attempt < eventSourceAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Second)
+		}
+		eventlog.Remove(serviceName)
+		err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
 type unregisterSvcCommand struct{}
 
 func (cmd unregisterSvcCommand) Name() string {
@@ -263,11 +419,30 @@ func (cmd unregisterSvcCommand) Run(args []string) error {
 	return nil
 }
 
+// hasForegroundFlag tells whether the -foreground flag is set in args, which
+// are not parsed yet when the service is detected.
+func hasForegroundFlag(args []string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		switch strings.TrimLeft(arg, "-") {
+		case "foreground", "foreground=true", "foreground=1":
+			return true
+		}
+	}
+	return false
+}
+
 func registerExtraCommands() {
-	isSvc, err := svc.IsWindowsService()
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(255)
+	isSvc := false
+	if !hasForegroundFlag(os.Args[1:]) {
+		var err error
+		isSvc, err = svc.IsWindowsService()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(255)
+		}
 	}
 	if isSvc {
 		elog, err := eventlog.Open(serviceName)
@@ -286,6 +461,11 @@ func registerExtraCommands() {
 		elog.Info(1, fmt.Sprintf("Service %s stopped", serviceName))
 		os.Exit(0)
 	} else {
-		commands = append(commands, newRegisterSvcCommand(true), unregisterSvcCommand{})
+		for _, cmd := range commands {
+			if serve, ok := cmd.(*serveCommand); ok {
+				serve.cli.Bool("foreground", false, "run the server in the console even when the process looks like a Windows service, stopping it with Ctrl+C")
+			}
+		}
+		commands = append(commands, newRegisterSvcCommand(true), unregisterSvcCommand{}, newLogsCommand())
 	}
 }
@@ -0,0 +1,147 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// compressibleExts are the extensions of the text assets served with a
+// generic content type.
+var compressibleExts = map[string]bool{
+	".cfg": true, ".cg": true, ".cgp": true, ".glsl": true, ".glslp": true, ".info": true,
+	".lpl": true, ".slang": true, ".slangp": true, ".txt": true,
+}
+
+// acceptsGzip tells whether the client accepts gzip encoded responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		name = strings.TrimSpace(name)
+		if (name == "gzip" || name == "*") && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// isCompressible tells whether a response can be gzip encoded.
+func isCompressible(name string, status int, header http.Header) bool {
+	if status != http.StatusOK || header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	if compressibleExts[strings.ToLower(path.Ext(name))] {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "application/json" || mediaType == "application/javascript" || mediaType == "application/xml" ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// setGzipHeaders updates the headers of a response whose body is gzip encoded.
+func setGzipHeaders(header http.Header) {
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	header.Set("Content-Encoding", "gzip")
+	header.Add("Vary", "Accept-Encoding")
+	if etag := header.Get("Etag"); strings.HasSuffix(etag, "\"") {
+		header.Set("Etag", strings.TrimSuffix(etag, "\"")+"-gzip\"")
+	}
+}
+
+// gzipBody is a reader of the gzip encoding of a body.
+type gzipBody struct {
+	src  io.ReadCloser
+	buf  bytes.Buffer
+	zw   *gzip.Writer
+	eof  bool
+	read []byte
+}
+
+func newGzipBody(src io.ReadCloser) *gzipBody {
+	result := &gzipBody{src: src, read: make([]byte, 32*1024)}
+	result.zw = gzip.NewWriter(&result.buf)
+	return result
+}
+
+func (g *gzipBody) Read(p []byte) (int, error) {
+	for g.buf.Len() == 0 && !g.eof {
+		n, err := g.src.Read(g.read)
+		if n > 0 {
+			g.zw.Write(g.read[:n])
+		}
+		if err == io.EOF {
+			g.zw.Close()
+			g.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if g.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return g.buf.Read(p)
+}
+
+func (g *gzipBody) Close() error {
+	return g.src.Close()
+}
+
+// gzipResponseWriter gzip encodes the response when it is compressible.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	name        string
+	zw          *gzip.Writer
+	wroteHeader bool
+}
+
+func (gw *gzipResponseWriter) WriteHeader(status int) {
+	gw.wroteHeader = true
+	if isCompressible(gw.name, status, gw.Header()) {
+		setGzipHeaders(gw.Header())
+		gw.zw = gzip.NewWriter(gw.ResponseWriter)
+	}
+	gw.ResponseWriter.WriteHeader(status)
+}
+
+func (gw *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.zw == nil {
+		return gw.ResponseWriter.Write(p)
+	}
+	return gw.zw.Write(p)
+}
+
+func (gw *gzipResponseWriter) Close() error {
+	if gw.zw == nil {
+		return nil
+	}
+	return gw.zw.Close()
+}
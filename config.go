@@ -0,0 +1,165 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// configDirValue is a flag value loading the options of the *.conf files of a
+// directory, sorted by name, into the flag set. Each line of a file is an
+// option, as NAME VALUE or NAME=VALUE, or NAME alone for a boolean option. The
+// empty lines and the ones starting with # are ignored.
+type configDirValue struct {
+	cli *flag.FlagSet
+	dir *string
+}
+
+func (v configDirValue) String() string {
+	if v.dir == nil {
+		return ""
+	}
+	return *v.dir
+}
+
+func (v configDirValue) Set(s string) error {
+	files, err := filepath.Glob(filepath.Join(s, "*.conf"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for _, name := range files {
+		if err := loadConfigFile(v.cli, name); err != nil {
+			return err
+		}
+	}
+	*v.dir = s
+	return nil
+}
+
+// loadConfigFile sets the options of a configuration file in cli.
+func loadConfigFile(cli *flag.FlagSet, name string) error {
+	if errs := applyConfigFile(cli, name, false); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// applyConfigFile sets the options of a configuration file in cli, and returns
+// the errors of its lines. With keepGoing, the lines following an invalid one
+// are applied as well, so that all the errors are returned.
+func applyConfigFile(cli *flag.FlagSet, name string, keepGoing bool) []error {
+	file, err := os.Open(name)
+	if err != nil {
+		return []error{err}
+	}
+	defer file.Close()
+	errs := []error{}
+	fail := func(err error) bool {
+		errs = append(errs, err)
+		return !keepGoing
+	}
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		option, value, found := strings.Cut(text, "=")
+		if i := strings.IndexAny(text, " \t"); i >= 0 && (!found || i < len(option)) {
+			option, value, found = text[:i], strings.TrimSpace(text[i+1:]), true
+		}
+		option = strings.TrimLeft(strings.TrimSpace(option), "-")
+		f := cli.Lookup(option)
+		if f == nil || option == "config-dir" {
+			if fail(fmt.Errorf("%s:%d: unknown option %s", name, line, option)) {
+				return errs
+			}
+			continue
+		}
+		if !found {
+			if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !boolFlag.IsBoolFlag() {
+				if fail(fmt.Errorf("%s:%d: missing value of option %s", name, line, option)) {
+					return errs
+				}
+				continue
+			}
+			value = "true"
+		}
+		if err := cli.Set(option, value); err != nil {
+			if fail(fmt.Errorf("%s:%d: invalid value %q of option %s: %v", name, line, value, option, err)) {
+				return errs
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// effectiveConfig is the JSON document written by the write-effective-config
+// option: the values of all the options, including the default ones, and the
+// names of the options set by the command line or the configuration files.
+type effectiveConfig struct {
+	Version string         `json:"version"`
+	Options map[string]any `json:"options"`
+	Set     []string       `json:"set"`
+}
+
+// isSecretOption tells whether the value of an option must not be written in
+// the effective configuration.
+func isSecretOption(name string) bool {
+	return strings.Contains(name, "token") || strings.Contains(name, "password") || strings.Contains(name, "secret") || strings.HasSuffix(name, "-upstream-header")
+}
+
+// writeEffectiveConfig writes the effective configuration of cli, once parsed,
+// to a JSON file. The values of the secret options are redacted.
+func writeEffectiveConfig(cli *flag.FlagSet, name string) error {
+	config := effectiveConfig{Version: version, Options: map[string]any{}, Set: []string{}}
+	cli.VisitAll(func(f *flag.Flag) {
+		var value any = f.Value.String()
+		if list, ok := f.Value.(*listValue); ok {
+			value = append([]string{}, *list...)
+		}
+		if isSecretOption(f.Name) && f.Value.String() != "" {
+			value = "REDACTED"
+		}
+		config.Options[f.Name] = value
+	})
+	cli.Visit(func(f *flag.Flag) {
+		config.Set = append(config.Set, f.Name)
+	})
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(data, '\n'), 0640)
+}
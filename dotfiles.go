@@ -0,0 +1,79 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+// isDotfile tells whether a file name starts with a dot.
+func isDotfile(name string) bool {
+	return strings.HasPrefix(name, ".") && name != "." && name != ".."
+}
+
+// indexFileNames are the index files which can be requested even though their
+// name starts with a dot.
+var indexFileNames = map[string]bool{
+	".index":          true,
+	".index-dirs":     true,
+	".index-extended": true,
+}
+
+// dotfileHider hides the files and directories of a source whose name starts
+// with a dot, such as .git or .DS_Store, from the listings and the requests.
+// The stored index files, such as .index-extended, can still be requested, but
+// not from a directory whose name starts with a dot.
+type dotfileHider struct {
+	http.FileSystem
+}
+
+func (hider dotfileHider) Open(name string) (http.File, error) {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		if isDotfile(part) && !(i == len(parts)-1 && indexFileNames[part]) {
+			return nil, fs.ErrNotExist
+		}
+	}
+	file, err := hider.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return dotfileHiddenDir{file}, nil
+}
+
+// dotfileHiddenDir hides the entries starting with a dot from a directory
+// listing.
+type dotfileHiddenDir struct {
+	http.File
+}
+
+func (d dotfileHiddenDir) Readdir(count int) ([]fs.FileInfo, error) {
+	files, err := d.File.Readdir(count)
+	result := files[:0]
+	for _, info := range files {
+		if !isDotfile(info.Name()) {
+			result = append(result, info)
+		}
+	}
+	return result, err
+}
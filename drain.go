@@ -0,0 +1,73 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// drainer rejects the new requests with a 503 Service Unavailable status once
+// the server is draining, while the requests in flight complete.
+type drainer struct {
+	next       http.Handler
+	retryAfter time.Duration
+	draining   atomic.Bool
+	inFlight   atomic.Int64
+}
+
+func (d *drainer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The request is counted before checking the state so that drain never
+	// misses it
+	d.inFlight.Add(1)
+	if d.draining.Load() {
+		d.inFlight.Add(-1)
+		if d.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int((d.retryAfter+time.Second-1)/time.Second)))
+		}
+		w.Header().Set("Connection", "close")
+		http.Error(w, "The server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer d.inFlight.Add(-1)
+	d.next.ServeHTTP(w, r)
+}
+
+// drain rejects the new requests of server until its requests in flight
+// complete, for period at most. It does nothing if the server has no drainer.
+func drain(server *http.Server, period time.Duration) {
+	d, ok := server.Handler.(*drainer)
+	if !ok || period <= 0 {
+		return
+	}
+	d.draining.Store(true)
+	server.SetKeepAlivesEnabled(false)
+	deadline := time.Now().Add(period)
+	for time.Now().Before(deadline) {
+		if d.inFlight.Load() == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	warnf("Drain period elapsed with %d requests in flight", d.inFlight.Load())
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"time"
+)
+
+const (
+	feedName     string = ".rss"
+	feedMaxItems int    = 50
+)
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title   string `xml:"title"`
+	Link    string `xml:"link"`
+	GUID    string `xml:"guid"`
+	PubDate string `xml:"pubDate"`
+}
+
+// serveFeed writes an RSS feed of the most recently modified files of the
+// directory of the requested .rss file.
+func (filesystem *fileSystem) serveFeed(w http.ResponseWriter, r *http.Request) {
+	_, s := startSpan(r.Context(), "generate "+feedName, spanKindInternal)
+	s.setAttribute("url.path", r.URL.Path)
+	defer s.finish()
+	dir := path.Dir(r.URL.Path[len(filesystem.Root)-1:])
+	files, err := filesystem.readDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		s.setError()
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	regular := []fs.FileInfo{}
+	for _, info := range files {
+		if info.Mode().IsRegular() {
+			regular = append(regular, info)
+		}
+	}
+	sort.Slice(regular, func(i, j int) bool {
+		return regular[i].ModTime().After(regular[j].ModTime())
+	})
+	if len(regular) > feedMaxItems {
+		regular = regular[:feedMaxItems]
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	link := (&url.URL{Scheme: scheme, Host: r.Host, Path: path.Dir(r.URL.Path) + "/"}).String()
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         "Latest files of " + path.Dir(r.URL.Path),
+			Link:          link,
+			Description:   "Files recently added to " + path.Dir(r.URL.Path),
+			LastBuildDate: time.Now().Format(time.RFC1123Z),
+		},
+	}
+	for _, info := range regular {
+		itemLink := link + url.PathEscape(info.Name())
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:   info.Name(),
+			Link:    itemLink,
+			GUID:    itemLink + "#" + info.ModTime().UTC().Format(time.RFC3339),
+			PubDate: info.ModTime().Format(time.RFC1123Z),
+		})
+	}
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(feed); err != nil {
+		s.setError()
+	}
+}
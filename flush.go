@@ -0,0 +1,79 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// flushReport is the JSON document served by the cache flush endpoint.
+type flushReport struct {
+	Listings      int   `json:"listings"`
+	Proxied       int   `json:"proxied"`
+	ProxiedBytes  int64 `json:"proxied_bytes"`
+	HeadResponses int   `json:"head_responses"`
+}
+
+// cacheFlusher clears the listings kept in memory, the proxy cache and the
+// HEAD cache. The prefix query parameter restricts the flush to the URL paths
+// starting with it.
+type cacheFlusher struct {
+	caches      cacheSet
+	heads       *headCache
+	filesystems []*fileSystem
+	// warm generates again in the background the listings of the routes
+	// whose listings are flushed.
+	warm bool
+}
+
+func (flusher *cacheFlusher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	report := flushReport{}
+	for _, filesystem := range flusher.filesystems {
+		count := filesystem.flushListings(prefix)
+		if count > 0 && flusher.warm {
+			go filesystem.warmListings()
+		}
+		report.Listings += count
+	}
+	for _, cache := range flusher.caches {
+		count, size, err := cache.flush(prefix)
+		report.Proxied += count
+		report.ProxiedBytes += size
+		if err != nil {
+			errorf("Proxy cache flush incomplete: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if flusher.heads != nil {
+		report.HeadResponses = flusher.heads.flush(prefix)
+	}
+	infof("Flushed %d listings, %d proxied files and %d HEAD responses under %q", report.Listings, report.Proxied, report.HeadResponses, prefix)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,267 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// mmdbMetadataMarker precedes the metadata at the end of a MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// geoIPDB looks up the country of the IP addresses in a MaxMind DB file, such
+// as GeoLite2-Country.mmdb, loaded in memory.
+type geoIPDB struct {
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// dataStart is the offset of the data section.
+	dataStart uint
+	// ipv4Start is the node of the IPv4 addresses in an IPv6 tree.
+	ipv4Start uint
+}
+
+// openGeoIPDB loads a MaxMind DB file.
+func openGeoIPDB(name string) (*geoIPDB, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	marker := bytes.LastIndex(data, mmdbMetadataMarker)
+	if marker < 0 {
+		return nil, fmt.Errorf("%s: not a MaxMind DB file", name)
+	}
+	metaStart := uint(marker + len(mmdbMetadataMarker))
+	decoder := &mmdbDecoder{data: data[metaStart:]}
+	value, _, err := decoder.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid metadata: %w", name, err)
+	}
+	metadata, _ := value.(map[string]any)
+	db := &geoIPDB{data: data}
+	for key, target := range map[string]*uint{"node_count": &db.nodeCount, "record_size": &db.recordSize, "ip_version": &db.ipVersion} {
+		number, ok := metadata[key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("%s: missing %s in the metadata", name, key)
+		}
+		*target = uint(number)
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", name, db.recordSize)
+	}
+	db.dataStart = db.nodeCount*db.recordSize/4 + 16
+	if db.dataStart > metaStart {
+		return nil, fmt.Errorf("%s: truncated search tree", name)
+	}
+	if db.ipVersion == 6 {
+		// The IPv4 addresses are mapped to ::a.b.c.d
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node.
+func (db *geoIPDB) record(node uint, bit uint) uint {
+	offset := node * db.recordSize / 4
+	b := db.data[offset : offset+db.recordSize/4]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	return uint(binary.BigEndian.Uint32(b[bit*4:]))
+}
+
+// country returns the ISO code of the country of an IP address, or an empty
+// string if it is unknown.
+func (db *geoIPDB) country(ip net.IP) string {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = db.ipv4Start
+	} else if db.ipVersion == 4 {
+		return ""
+	}
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(ip[i/8]>>(7-i%8))&1)
+	}
+	if node <= db.nodeCount {
+		return ""
+	}
+	offset := node - db.nodeCount - 16
+	decoder := &mmdbDecoder{data: db.data[db.dataStart:]}
+	value, _, err := decoder.decode(offset)
+	if err != nil {
+		return ""
+	}
+	fields, _ := value.(map[string]any)
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := fields[key].(map[string]any); ok {
+			if code, ok := country["iso_code"].(string); ok {
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+// mmdbDecoder decodes the values of the data section of a MaxMind DB file.
+// The unsigned integers are decoded as uint64, except the 128-bit ones which
+// are kept as bytes.
+type mmdbDecoder struct {
+	data []byte
+}
+
+// bytes returns the n bytes at offset.
+func (d *mmdbDecoder) bytes(offset, n uint) ([]byte, error) {
+	if offset+n > uint(len(d.data)) || offset+n < offset {
+		return nil, fmt.Errorf("unexpected end of data at %d", offset)
+	}
+	return d.data[offset : offset+n], nil
+}
+
+// uint decodes a big-endian unsigned integer of n bytes.
+func (d *mmdbDecoder) uint(offset, n uint) (uint64, error) {
+	b, err := d.bytes(offset, n)
+	if err != nil {
+		return 0, err
+	}
+	result := uint64(0)
+	for _, c := range b {
+		result = result<<8 | uint64(c)
+	}
+	return result, nil
+}
+
+// decode returns the value at offset and the offset following it.
+func (d *mmdbDecoder) decode(offset uint) (any, uint, error) {
+	ctrl, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+	kind := uint(ctrl[0] >> 5)
+	if kind == 1 {
+		// Pointer to a value of the data section
+		size := uint(ctrl[0]>>3) & 3
+		b, err := d.bytes(offset, size+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		target := uint(ctrl[0] & 7)
+		if size == 3 {
+			target = 0
+		}
+		for _, c := range b {
+			target = target<<8 | uint(c)
+		}
+		target += []uint{0, 2048, 526336, 0}[size]
+		if b, err := d.bytes(target, 1); err == nil && b[0]>>5 == 1 {
+			return nil, 0, fmt.Errorf("pointer to a pointer at %d", offset)
+		}
+		value, _, err := d.decode(target)
+		return value, offset + size + 1, err
+	}
+	if kind == 0 {
+		extended, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + uint(extended[0])
+		offset++
+	}
+	size := uint(ctrl[0] & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		extra, err := d.uint(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		size = []uint{29, 285, 65821}[n-1] + uint(extra)
+		offset += n
+	}
+	switch kind {
+	case 2:
+		b, err := d.bytes(offset, size)
+		return string(b), offset + size, err
+	case 3:
+		number, err := d.uint(offset, 8)
+		return math.Float64frombits(number), offset + 8, err
+	case 4, 10:
+		b, err := d.bytes(offset, size)
+		return b, offset + size, err
+	case 5, 6, 9:
+		number, err := d.uint(offset, size)
+		return number, offset + size, err
+	case 8:
+		number, err := d.uint(offset, size)
+		return int32(number), offset + size, err
+	case 7:
+		result := map[string]any{}
+		for i := uint(0); i < size; i++ {
+			var key, value any
+			key, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("invalid map key at %d", offset)
+			}
+			result[name] = value
+		}
+		return result, offset, nil
+	case 11:
+		result := []any{}
+		for i := uint(0); i < size; i++ {
+			var value any
+			value, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			result = append(result, value)
+		}
+		return result, offset, nil
+	case 14:
+		return size != 0, offset, nil
+	case 15:
+		number, err := d.uint(offset, 4)
+		return math.Float32frombits(uint32(number)), offset + 4, err
+	}
+	return nil, 0, fmt.Errorf("unsupported type %d at %d", kind, offset)
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMMDBDecode(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want any
+	}{
+		{[]byte{0x40}, ""},
+		{[]byte{0x43, 'a', 'b', 'c'}, "abc"},
+		{append([]byte{0x5d, 0x00}, bytes.Repeat([]byte{'x'}, 29)...), string(bytes.Repeat([]byte{'x'}, 29))},
+		{append([]byte{0x5e, 0x00, 0x0f}, bytes.Repeat([]byte{'x'}, 300)...), string(bytes.Repeat([]byte{'x'}, 300))},
+		{[]byte{0x68, 0x40, 0x09, 0x21, 0xfb, 0x54, 0x44, 0x2d, 0x18}, math.Pi},
+		{[]byte{0x83, 1, 2, 3}, []byte{1, 2, 3}},
+		{[]byte{0xa0}, uint64(0)},
+		{[]byte{0xa2, 0x01, 0xf4}, uint64(500)},
+		{[]byte{0xc4, 0xff, 0xff, 0xff, 0xff}, uint64(math.MaxUint32)},
+		{[]byte{0x04, 0x01, 0xff, 0xff, 0xff, 0xff}, int32(-1)},
+		{[]byte{0x08, 0x02, 1, 0, 0, 0, 0, 0, 0, 0}, uint64(1) << 56},
+		{[]byte{0x02, 0x03, 1, 2}, []byte{1, 2}},
+		{[]byte{0xe1, 0x42, 'i', 'd', 0xa1, 0x07}, map[string]any{"id": uint64(7)}},
+		{[]byte{0x02, 0x04, 0x41, 'a', 0xa1, 0x01}, []any{"a", uint64(1)}},
+		{[]byte{0x01, 0x07}, true},
+		{[]byte{0x00, 0x07}, false},
+		{[]byte{0x04, 0x08, 0x3f, 0xc0, 0x00, 0x00}, float32(1.5)},
+	}
+	for _, test := range tests {
+		decoder := &mmdbDecoder{data: test.data}
+		got, next, err := decoder.decode(0)
+		if err != nil {
+			t.Errorf("% x: %v", test.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("% x: got %#v, want %#v", test.data, got, test.want)
+		}
+		if next != uint(len(test.data)) {
+			t.Errorf("% x: next offset %d, want %d", test.data, next, len(test.data))
+		}
+	}
+}
+
+func TestMMDBDecodePointers(t *testing.T) {
+	data := make([]byte, 526336+2)
+	copy(data, []byte{0x41, 'a'})
+	copy(data[0x0304:], []byte{0x41, 'b'})
+	copy(data[2048+0x030405:], []byte{0x41, 'c'})
+	copy(data[526336:], []byte{0x41, 'd'})
+	data = append(data, 0x41, 'e')
+	pointers := []struct {
+		data []byte
+		want string
+	}{
+		{[]byte{0x20, 0x00}, "a"},
+		{[]byte{0x23, 0x04}, "b"},
+		{[]byte{0x2b, 0x04, 0x05}, "c"},
+		{[]byte{0x30, 0x00, 0x00, 0x00}, "d"},
+		{[]byte{0x38, 0x00, 0x08, 0x08, 0x02}, "e"},
+	}
+	for _, pointer := range pointers {
+		decoder := &mmdbDecoder{data: append(append([]byte{}, data...), pointer.data...)}
+		got, next, err := decoder.decode(uint(len(data)))
+		if err != nil {
+			t.Errorf("% x: %v", pointer.data, err)
+			continue
+		}
+		if got != pointer.want {
+			t.Errorf("% x: got %#v, want %q", pointer.data, got, pointer.want)
+		}
+		if next != uint(len(data)+len(pointer.data)) {
+			t.Errorf("% x: next offset %d, want %d", pointer.data, next, len(data)+len(pointer.data))
+		}
+	}
+}
+
+func TestMMDBDecodeTruncated(t *testing.T) {
+	for _, data := range [][]byte{{}, {0x43, 'a'}, {0xe1, 0x42, 'i', 'd'}, {0x5e, 0x00}, {0x20}} {
+		decoder := &mmdbDecoder{data: data}
+		if _, _, err := decoder.decode(0); err == nil {
+			t.Errorf("% x: no error", data)
+		}
+	}
+}
+
+// mmdbTestRecord encodes the records of a node of the search tree.
+func mmdbTestRecord(recordSize uint, left, right uint) []byte {
+	switch recordSize {
+	case 24:
+		return []byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)}
+	case 28:
+		return []byte{byte(left >> 16), byte(left >> 8), byte(left), byte(left>>24)<<4 | byte(right>>24)&0x0f, byte(right >> 16), byte(right >> 8), byte(right)}
+	}
+	return binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, uint32(left)), uint32(right))
+}
+
+// writeTestMMDB writes a database where 1.0.0.0/8 is in AU and 0.0.0.0/8 is
+// registered in FR, through a pointer, the IPv4 addresses of an IPv6 database
+// being under ::/96.
+func writeTestMMDB(t *testing.T, recordSize, ipVersion uint) string {
+	zeros := uint(0)
+	if ipVersion == 6 {
+		zeros = 96
+	}
+	nodeCount := zeros + 8
+	data := []byte{0xe1, 0x47}
+	data = append(data, "country"...)
+	data = append(data, 0xe1, 0x48)
+	data = append(data, "iso_code"...)
+	data = append(data, 0x42, 'A', 'U')
+	registered := uint(len(data))
+	data = append(data, 0xe1, 0x52)
+	data = append(data, "registered_country"...)
+	data = append(data, 0xe1, 0x48)
+	data = append(data, "iso_code"...)
+	data = append(data, 0x20, byte(len(data)+2))
+	data = append(data, 0x42, 'F', 'R')
+	tree := []byte{}
+	for node := uint(0); node < nodeCount-1; node++ {
+		tree = append(tree, mmdbTestRecord(recordSize, node+1, nodeCount)...)
+	}
+	tree = append(tree, mmdbTestRecord(recordSize, nodeCount+16+registered, nodeCount+16)...)
+	file := append(tree, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, mmdbMetadataMarker...)
+	file = append(file, 0xe3)
+	file = append(file, 0x4a)
+	file = append(file, "node_count"...)
+	file = append(file, 0xc2, byte(nodeCount>>8), byte(nodeCount))
+	file = append(file, 0x4b)
+	file = append(file, "record_size"...)
+	file = append(file, 0xa1, byte(recordSize))
+	file = append(file, 0x4a)
+	file = append(file, "ip_version"...)
+	file = append(file, 0xa1, byte(ipVersion))
+	name := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(name, file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestGeoIPCountry(t *testing.T) {
+	for _, recordSize := range []uint{24, 28, 32} {
+		for _, ipVersion := range []uint{4, 6} {
+			db, err := openGeoIPDB(writeTestMMDB(t, recordSize, ipVersion))
+			if err != nil {
+				t.Fatalf("record size %d, IPv%d: %v", recordSize, ipVersion, err)
+			}
+			lookups := map[string]string{
+				"1.2.3.4":     "AU",
+				"1.255.0.1":   "AU",
+				"0.1.2.3":     "FR",
+				"2.0.0.1":     "",
+				"128.0.0.1":   "",
+				"2001:db8::1": "",
+			}
+			for ip, want := range lookups {
+				if got := db.country(net.ParseIP(ip)); got != want {
+					t.Errorf("%s: record size %d, IPv%d: got %q, want %q", ip, recordSize, ipVersion, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestOpenGeoIPDBInvalid(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "invalid.mmdb")
+	for _, content := range [][]byte{[]byte("not a database"), append(append([]byte{}, mmdbMetadataMarker...), 0xe0)} {
+		if err := os.WriteFile(name, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := openGeoIPDB(name); err == nil {
+			t.Errorf("%q: no error", content)
+		}
+	}
+}
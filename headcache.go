@@ -0,0 +1,156 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headCachedHeaders are the response headers kept by the HEAD cache.
+var headCachedHeaders = []string{"Accept-Ranges", "Content-Encoding", "Content-Length", "Content-Type", "Etag", "Last-Modified"}
+
+// headResponse is a response of the upstream server to a HEAD request.
+type headResponse struct {
+	status int
+	header http.Header
+	stored time.Time
+}
+
+// headCache keeps in memory the responses of the upstream server to the HEAD
+// requests during ttl, so that the clients checking the existence or the size
+// of the assets do not reach the upstream server each time. Only the found
+// and not found responses are kept.
+type headCache struct {
+	ttl        time.Duration
+	keyQuery   bool
+	keyHeaders []string
+	next       http.Handler
+	mutex      sync.Mutex
+	responses  map[string]*headResponse
+	swept      time.Time
+}
+
+func newHeadCache(ttl time.Duration, opts *serverOptions, next http.Handler) *headCache {
+	return &headCache{ttl: ttl, keyQuery: opts.cacheKeyQuery, keyHeaders: opts.cacheKeyHeaders, next: next, responses: map[string]*headResponse{}, swept: time.Now()}
+}
+
+// get returns the response of key if it is not expired.
+func (hc *headCache) get(key string) *headResponse {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	response := hc.responses[key]
+	if response == nil || time.Since(response.stored) > hc.ttl {
+		return nil
+	}
+	return response
+}
+
+// put stores the response of key, and removes the expired ones.
+func (hc *headCache) put(key string, response *headResponse) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	if now := time.Now(); now.Sub(hc.swept) > hc.ttl {
+		for old, stored := range hc.responses {
+			if now.Sub(stored.stored) > hc.ttl {
+				delete(hc.responses, old)
+			}
+		}
+		hc.swept = now
+	}
+	hc.responses[key] = response
+}
+
+// flush removes the responses whose key starts with prefix, and returns their
+// number.
+func (hc *headCache) flush(prefix string) int {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	count := 0
+	for key := range hc.responses {
+		if strings.HasPrefix(key, prefix) {
+			delete(hc.responses, key)
+			count++
+		}
+	}
+	return count
+}
+
+// headRecorder records the status and the headers of a response to a HEAD
+// request.
+type headRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *headRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *headRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+func (rec *headRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (hc *headCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodHead || !isCacheable(r) {
+		hc.next.ServeHTTP(w, r)
+		return
+	}
+	key := requestCacheKey(r, hc.keyQuery, hc.keyHeaders)
+	if r.Context().Value(gzipAccepted{}) != nil {
+		// The compressed responses differ
+		key += "\ngzip"
+	}
+	if response := hc.get(key); response != nil {
+		debugf("Served HEAD %s from the cache", r.URL.RequestURI())
+		for name, values := range response.header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(response.status)
+		return
+	}
+	rec := &headRecorder{ResponseWriter: w}
+	hc.next.ServeHTTP(rec, r)
+	if rec.status != http.StatusOK && rec.status != http.StatusNotFound {
+		return
+	}
+	response := &headResponse{status: rec.status, header: http.Header{}, stored: time.Now()}
+	for _, name := range headCachedHeaders {
+		if values := w.Header().Values(name); len(values) > 0 {
+			response.header[name] = values
+		}
+	}
+	hc.put(key, response)
+}
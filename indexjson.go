@@ -0,0 +1,149 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const indexJSONName string = ".index.json"
+
+// indexJSONEntry describes a file of an .index.json page.
+type indexJSONEntry struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// indexJSONPage is a page of the files of a directory, sorted by name.
+type indexJSONPage struct {
+	Total   int              `json:"total"`
+	Offset  int              `json:"offset"`
+	Entries []indexJSONEntry `json:"entries"`
+}
+
+// pageParameter returns the value of a non-negative integer query parameter,
+// or 0 if it is absent.
+func pageParameter(r *http.Request, name string) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	result, err := strconv.Atoi(value)
+	if err != nil || result < 0 {
+		return 0, fmt.Errorf("Invalid %s parameter %s", name, value)
+	}
+	return result, nil
+}
+
+// prefersJSON tells whether the Accept header of a request gives a higher
+// quality to JSON than to HTML and plain text.
+func prefersJSON(r *http.Request) bool {
+	jsonQuality := 0.0
+	textQuality := 0.0
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, _ := strings.Cut(accepted, ";")
+		quality := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if name, value, _ := strings.Cut(strings.TrimSpace(param), "="); name == "q" {
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/json":
+			jsonQuality = quality
+		case "text/html", "text/plain":
+			if quality > textQuality {
+				textQuality = quality
+			}
+		}
+	}
+	return jsonQuality > textQuality
+}
+
+// serveIndexJSON writes the files of the directory of the requested
+// .index.json file as JSON. The offset and limit query parameters select a
+// page of the files, only this page being encoded. All the files are included
+// when limit is absent or 0.
+func (filesystem *fileSystem) serveIndexJSON(w http.ResponseWriter, r *http.Request) {
+	_, s := startSpan(r.Context(), "generate "+indexJSONName, spanKindInternal)
+	s.setAttribute("url.path", r.URL.Path)
+	defer s.finish()
+	offset, err := pageParameter(r, "offset")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := pageParameter(r, "limit")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dir := path.Dir(r.URL.Path[len(filesystem.Root)-1:])
+	files, err := filesystem.readDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		s.setError()
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	regular := []fs.FileInfo{}
+	for _, info := range files {
+		if info.Mode().IsRegular() {
+			regular = append(regular, info)
+		}
+	}
+	sort.Slice(regular, func(i, j int) bool {
+		return regular[i].Name() < regular[j].Name()
+	})
+
+	page := indexJSONPage{Total: len(regular), Offset: offset, Entries: []indexJSONEntry{}}
+	if offset < len(regular) {
+		regular = regular[offset:]
+		if limit > 0 && limit < len(regular) {
+			regular = regular[:limit]
+		}
+		for _, info := range regular {
+			page.Entries = append(page.Entries, indexJSONEntry{Name: info.Name(), Size: info.Size(), Modified: info.ModTime()})
+		}
+	}
+	if filesystem.IndexMaxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int64(filesystem.IndexMaxAge/time.Second)))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil && r.Context().Err() == nil {
+		// Not an error of the server when the client went away
+		s.setError()
+	}
+}
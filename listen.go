@@ -0,0 +1,444 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	interfaceIPAll string = "all"
+	interfaceIPv4  string = "ipv4"
+	interfaceIPv6  string = "ipv6"
+)
+
+// listenAddresses returns the addresses to listen to for the listen address.
+// When an interface is provided, its addresses are used along with the port of
+// the listen address.
+func listenAddresses(opts *serverOptions, listen string) ([]string, error) {
+	if opts.iface == "" {
+		return []string{listen}, nil
+	}
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, err
+	}
+	iface, err := net.InterfaceByName(opts.iface)
+	if err != nil {
+		return nil, fmt.Errorf("Interface %s: %w", opts.iface, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("Interface %s: %w", opts.iface, err)
+	}
+	result := []string{}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		isIPv4 := ipNet.IP.To4() != nil
+		if (opts.interfaceIP == interfaceIPv4 && !isIPv4) || (opts.interfaceIP == interfaceIPv6 && isIPv4) {
+			continue
+		}
+		host := ipNet.IP.String()
+		if !isIPv4 && ipNet.IP.IsLinkLocalUnicast() {
+			host += "%" + iface.Name
+		}
+		result = append(result, net.JoinHostPort(host, port))
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("Interface %s has no usable address", opts.iface)
+	}
+	return result, nil
+}
+
+// listen opens the listeners of the server, unless they are inherited from
+// the parent process. The listeners of the TLS listen address, if any, follow
+// the other ones.
+func listen(opts *serverOptions) ([]net.Listener, error) {
+	if inherited, tls, err := inheritedListeners(); err != nil || len(inherited) > 0 {
+		if err == nil && opts.listenTLS != "" {
+			for i, listener := range inherited {
+				if tls[i] {
+					setListenTLSPort(opts, listener)
+					break
+				}
+			}
+		}
+		return inherited, err
+	}
+	addrs, err := listenAddresses(opts, opts.listen)
+	if err != nil {
+		return nil, err
+	}
+	result, err := bindAll(addrs, opts)
+	if err != nil || opts.listenTLS == "" {
+		return result, err
+	}
+	tlsAddrs, err := listenAddresses(opts, opts.listenTLS)
+	if err == nil {
+		var tlsListeners []net.Listener
+		tlsListeners, err = bindAll(tlsAddrs, opts)
+		if err == nil {
+			setListenTLSPort(opts, tlsListeners[0])
+			result = append(result, tlsListeners...)
+		}
+	}
+	if err != nil {
+		for _, l := range result {
+			l.Close()
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+// setListenTLSPort replaces the port of the TLS listen address with the one of
+// a TLS listener, since the port picked for a TLS listen address with port 0
+// tells the TLS listeners apart.
+func setListenTLSPort(opts *serverOptions, listener net.Listener) {
+	host, _, _ := net.SplitHostPort(opts.listenTLS)
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	opts.listenTLS = net.JoinHostPort(host, port)
+}
+
+// bindAll opens the listeners of addresses sharing the same port. When this
+// port is 0, the one picked by the system for the first address is used for
+// the other ones.
+func bindAll(addrs []string, opts *serverOptions) ([]net.Listener, error) {
+	result := []net.Listener{}
+	port := ""
+	for _, addr := range addrs {
+		if port != "" {
+			host, _, _ := net.SplitHostPort(addr)
+			addr = net.JoinHostPort(host, port)
+		}
+		listener, err := bind(addr, opts)
+		if err != nil {
+			for _, l := range result {
+				l.Close()
+			}
+			return nil, err
+		}
+		if _, p, _ := net.SplitHostPort(addr); p == "0" {
+			_, port, _ = net.SplitHostPort(listener.Addr().String())
+		}
+		result = append(result, listener)
+	}
+	return result, nil
+}
+
+// bind opens a listener on addr. A positive listen backlog sets the size of its
+// listen queue, and the reuseport option lets other processes listen to the
+// same port.
+func bind(addr string, opts *serverOptions) (net.Listener, error) {
+	config := net.ListenConfig{}
+	if opts.reusePort {
+		config.Control = setReusePort
+	}
+	listener, err := config.Listen(context.Background(), "tcp", addr)
+	if err == nil && opts.listenBacklog > 0 {
+		err = setListenBacklog(listener, opts.listenBacklog)
+		if err != nil {
+			listener.Close()
+		}
+	}
+	return listener, err
+}
+
+// limitListener caps the number of accepted connections which are not closed
+// yet. The slots are shared by all the listeners of the server: the
+// connections in excess wait in the listen backlog until a slot is freed.
+type limitListener struct {
+	net.Listener
+	slots     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitConn{Conn: conn, release: func() { <-l.slots }}, nil
+}
+
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+// limitConn frees its slot of a limitListener when closed.
+type limitConn struct {
+	net.Conn
+	release     func()
+	releaseOnce sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
+
+// serve runs the server on all the listeners until it is shut down or one of
+// them fails, in which case the server is closed. When maxConnections is
+// positive, the number of concurrent connections is capped. When the server
+// has a TLS configuration, the listeners only accept TLS connections, unless
+// a TLS listen address is provided: only the listeners on its port accept TLS
+// connections then. A failed listener is bound again up to listenRetries times
+// before it is considered failed.
+func serve(server *http.Server, listeners []net.Listener, opts *serverOptions) error {
+	errs := make(chan error, len(listeners))
+	var slots chan struct{}
+	if opts.maxConnections > 0 {
+		slots = make(chan struct{}, opts.maxConnections)
+	}
+	tlsPort := ""
+	if opts.listenTLS != "" {
+		_, tlsPort, _ = net.SplitHostPort(opts.listenTLS)
+	}
+	// Serve sets a default TLS configuration to enable HTTP/2
+	hasTLS := server.TLSConfig != nil
+	listenersMutex.Lock()
+	servedTLS = make([]bool, len(listeners))
+	for i := range listeners {
+		_, port, _ := net.SplitHostPort(listeners[i].Addr().String())
+		servedTLS[i] = hasTLS && (tlsPort == "" || port == tlsPort)
+	}
+	listenersMutex.Unlock()
+	for i := range listeners {
+		go func(i int, useTLS bool) {
+			errs <- serveListener(server, listeners, i, useTLS, slots, opts)
+		}(i, servedTLS[i])
+	}
+	var result error
+	for range listeners {
+		err := <-errs
+		if err != http.ErrServerClosed && result == nil {
+			result = err
+			server.Close()
+		}
+	}
+	return result
+}
+
+// listenersMutex guards the elements of the served listeners, which are
+// replaced when they are bound again, and servedTLS.
+var listenersMutex sync.Mutex
+
+// servedTLS tells whether each served listener accepts TLS connections, which
+// a graceful restart hands over to the new process.
+var servedTLS []bool
+
+// serveListener runs the server on the listener at index i of listeners. When
+// the listener fails, it is replaced by a new listener bound to the same
+// address, after a delay doubled on each retry. When the listener is replaced
+// by reloadListeners, the new one is served instead.
+func serveListener(server *http.Server, listeners []net.Listener, i int, useTLS bool, slots chan struct{}, opts *serverOptions) error {
+	listenersMutex.Lock()
+	addr := listeners[i].Addr().String()
+	listenersMutex.Unlock()
+	delay := opts.listenRetryDelay
+	retries := 0
+	for {
+		listenersMutex.Lock()
+		served := listeners[i]
+		listenersMutex.Unlock()
+		listener := served
+		if slots != nil {
+			listener = &limitListener{Listener: listener, slots: slots, done: make(chan struct{})}
+		}
+		var err error
+		if useTLS {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err == http.ErrServerClosed {
+			return err
+		}
+		listenersMutex.Lock()
+		replaced := listeners[i] != served
+		if replaced {
+			addr = listeners[i].Addr().String()
+		}
+		listenersMutex.Unlock()
+		if replaced {
+			delay, retries = opts.listenRetryDelay, 0
+			continue
+		}
+		for {
+			if retries >= opts.listenRetries {
+				return err
+			}
+			retries++
+			warnf("Listener %s failed: %v, binding it again in %s", addr, err, delay)
+			time.Sleep(delay)
+			delay *= 2
+			var rebound net.Listener
+			rebound, err = bind(addr, opts)
+			if err == nil {
+				infof("Listening on %s", rebound.Addr())
+				listenersMutex.Lock()
+				listeners[i] = rebound
+				listenersMutex.Unlock()
+				break
+			}
+		}
+	}
+}
+
+// sameAddress tells whether a listener is bound to addr. A port 0 matches any
+// port, since it is picked by the system.
+func sameAddress(current net.Addr, addr string) bool {
+	tcpAddr, ok := current.(*net.TCPAddr)
+	resolved, err := net.ResolveTCPAddr("tcp", addr)
+	if !ok || err != nil {
+		return current.String() == addr
+	}
+	if resolved.Port != 0 && resolved.Port != tcpAddr.Port {
+		return false
+	}
+	if resolved.IP == nil || resolved.IP.IsUnspecified() {
+		return tcpAddr.IP.IsUnspecified()
+	}
+	return resolved.IP.Equal(tcpAddr.IP) && resolved.Zone == tcpAddr.Zone
+}
+
+// reloadListeners replaces the served listeners whose address differs from
+// the one of opts, such as the address of an interface whose DHCP lease
+// changed, with new listeners. The old listeners are closed once the new ones
+// are bound: their current connections are served until they complete. The
+// number of addresses must not change.
+func reloadListeners(listeners []net.Listener, opts *serverOptions) error {
+	addrs, err := listenAddresses(opts, opts.listen)
+	if err != nil {
+		return err
+	}
+	if opts.listenTLS != "" {
+		tlsAddrs, err := listenAddresses(opts, opts.listenTLS)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, tlsAddrs...)
+	}
+	listenersMutex.Lock()
+	current := append([]net.Listener{}, listeners...)
+	listenersMutex.Unlock()
+	if len(addrs) != len(current) {
+		return fmt.Errorf("The number of listening addresses changed from %d to %d, which requires a restart", len(current), len(addrs))
+	}
+	for i, addr := range addrs {
+		if sameAddress(current[i].Addr(), addr) {
+			continue
+		}
+		if host, port, _ := net.SplitHostPort(addr); port == "0" {
+			_, port, _ = net.SplitHostPort(current[i].Addr().String())
+			addr = net.JoinHostPort(host, port)
+		}
+		listener, err := bind(addr, opts)
+		if err != nil {
+			return err
+		}
+		listenersMutex.Lock()
+		listeners[i] = listener
+		listenersMutex.Unlock()
+		infof("Listening on %s instead of %s", listener.Addr(), current[i].Addr())
+		current[i].Close()
+	}
+	return nil
+}
+
+var (
+	shutdownHooksMutex sync.Mutex
+	shutdownHooks      = map[*http.Server][]func(){}
+)
+
+// onShutdown registers a function run by shutdown once the requests of the
+// server are complete or interrupted. Unlike the functions registered with
+// RegisterOnShutdown, it is not run concurrently with the last requests.
+func onShutdown(server *http.Server, hook func()) {
+	shutdownHooksMutex.Lock()
+	defer shutdownHooksMutex.Unlock()
+	shutdownHooks[server] = append(shutdownHooks[server], hook)
+}
+
+// shutdown gracefully shuts the server down. If the requests are not complete
+// once timeout is elapsed, their connections are closed. A timeout which is
+// not positive waits for the requests indefinitely.
+func shutdown(server *http.Server, timeout time.Duration) error {
+	ctxt := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctxt, cancel = context.WithTimeout(ctxt, timeout)
+		defer cancel()
+	}
+	err := server.Shutdown(ctxt)
+	if err != nil {
+		server.Close()
+	}
+	shutdownHooksMutex.Lock()
+	hooks := shutdownHooks[server]
+	delete(shutdownHooks, server)
+	shutdownHooksMutex.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+	return err
+}
+
+// watchShutdown gracefully shuts the server down on SIGINT or SIGTERM, after
+// draining its requests for drainPeriod at most. The returned channel is
+// closed once the shutdown is complete.
+func watchShutdown(server *http.Server, drainPeriod, timeout time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		infof("Shutting down, waiting for the current requests to complete")
+		drain(server, drainPeriod)
+		if err := shutdown(server, timeout); err != nil {
+			warnf("Requests interrupted: %v", err)
+		}
+		close(done)
+	}()
+	return done
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cachedListing is a generated listing along with the modification time of
+// its directory when it was generated.
+type cachedListing struct {
+	content    string
+	dirModTime time.Time
+}
+
+// listingCache keeps the generated listings of a route in memory, so that they
+// are not generated when they are requested.
+type listingCache struct {
+	mutex    sync.Mutex
+	listings map[string]*cachedListing
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+func newListingCache() *listingCache {
+	return &listingCache{listings: map[string]*cachedListing{}}
+}
+
+// dirModTime returns the modification time of a directory of the source, or
+// the zero time if it is unknown.
+func (filesystem *fileSystem) dirModTime(dir string) time.Time {
+	d, err := filesystem.Source.Open(dir)
+	if err != nil {
+		return time.Time{}
+	}
+	defer d.Close()
+	info, err := d.Stat()
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// cachedListing returns the content of a listing from the cache, generating it
+// if it is not cached yet.
+func (filesystem *fileSystem) cachedListing(name string) (string, error) {
+	cache := filesystem.Listings
+	cache.mutex.Lock()
+	listing, found := cache.listings[name]
+	cache.mutex.Unlock()
+	if found {
+		return listing.content, nil
+	}
+	return filesystem.refreshListing(name)
+}
+
+// countRequest records a request of a listing as a hit when it is cached, and
+// as a miss otherwise.
+func (cache *listingCache) countRequest(name string) {
+	cache.mutex.Lock()
+	_, found := cache.listings[name]
+	cache.mutex.Unlock()
+	if found {
+		cache.hits.Add(1)
+	} else {
+		cache.misses.Add(1)
+	}
+}
+
+// refreshListing generates a listing and stores it in the cache. A listing
+// which cannot be generated anymore, such as the one of a removed directory,
+// is removed from the cache.
+func (filesystem *fileSystem) refreshListing(name string) (string, error) {
+	cache := filesystem.Listings
+	dirModTime := filesystem.dirModTime(path.Dir(name))
+	content, err := filesystem.generateListing(name)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if err != nil {
+		if _, found := cache.listings[name]; found {
+			delete(cache.listings, name)
+			cache.evictions.Add(1)
+		}
+		return "", err
+	}
+	cache.listings[name] = &cachedListing{content: content, dirModTime: dirModTime}
+	return content, nil
+}
+
+// refreshListings periodically generates again the cached listings whose
+// directory changed. The listings of the directories without a known
+// modification time, such as the ones of remote sources, are always generated
+// again.
+func (filesystem *fileSystem) refreshListings(interval time.Duration) {
+	cache := filesystem.Listings
+	for range time.Tick(interval) {
+		cache.mutex.Lock()
+		modTimes := make(map[string]time.Time, len(cache.listings))
+		for name, listing := range cache.listings {
+			modTimes[name] = listing.dirModTime
+		}
+		cache.mutex.Unlock()
+		for name, modTime := range modTimes {
+			current := filesystem.dirModTime(path.Dir(name))
+			if current.IsZero() || !current.Equal(modTime) {
+				filesystem.refreshListing(name)
+			}
+		}
+	}
+}
+
+// warmListings generates and caches the listings of the route: its .index
+// file and, with subdirectories, its .index-dirs file and the .index files of
+// the listed subdirectories. It returns the number of generated listings.
+func (filesystem *fileSystem) warmListings() int {
+	names := []string{"/.index"}
+	if filesystem.SubDirs {
+		names = append(names, "/.index-dirs")
+		dirs, err := filesystem.indexDirs()
+		if err != nil {
+			warnf("Listing warmup of %s incomplete: %v", filesystem.Root, err)
+		}
+		for _, dir := range dirs {
+			names = append(names, path.Join("/", dir, ".index"))
+		}
+	}
+	count := 0
+	for _, name := range names {
+		if _, err := filesystem.refreshListing(name); err != nil {
+			warnf("Listing warmup of %s incomplete: %v", path.Join(filesystem.Root, name), err)
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// flushListings removes the cached listings whose URL path starts with prefix, and
+// returns the number of removed listings.
+func (filesystem *fileSystem) flushListings(prefix string) int {
+	cache := filesystem.Listings
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	count := 0
+	for name := range cache.listings {
+		if strings.HasPrefix(filesystem.Root+name[1:], prefix) {
+			delete(cache.listings, name)
+			cache.evictions.Add(1)
+			count++
+		}
+	}
+	return count
+}
+
+// listingStats returns the counters of the cached listings of the route.
+func (filesystem *fileSystem) listingStats() cacheStats {
+	cache := filesystem.Listings
+	cache.mutex.Lock()
+	size := int64(0)
+	for _, listing := range cache.listings {
+		size += int64(len(listing.content))
+	}
+	cache.mutex.Unlock()
+	return cacheStats{Name: "index " + filesystem.Root, Hits: cache.hits.Load(), Misses: cache.misses.Load(), Evictions: cache.evictions.Load(), Size: size}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// Levels of the log messages, by increasing severity.
+const (
+	levelDebug int = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// logLevelNames are the names of the levels, indexed by level.
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// logLevel is the minimum level of the logged messages.
+var logLevel = levelInfo
+
+// setLogLevel sets the minimum level of the logged messages from its name.
+// Unknown names are ignored.
+func setLogLevel(name string) {
+	for level, levelName := range logLevelNames {
+		if name == levelName {
+			logLevel = level
+		}
+	}
+}
+
+// logf logs a message if its level is enabled, prefixed with the level.
+func logf(level int, format string, args ...any) {
+	if level < logLevel {
+		return
+	}
+	log.Printf(strings.ToUpper(logLevelNames[level])+" "+format, args...)
+}
+
+func debugf(format string, args ...any) {
+	logf(levelDebug, format, args...)
+}
+
+func infof(format string, args ...any) {
+	logf(levelInfo, format, args...)
+}
+
+func warnf(format string, args ...any) {
+	logf(levelWarn, format, args...)
+}
+
+func errorf(format string, args ...any) {
+	logf(levelError, format, args...)
+}
+
+// dumpf logs a request dump, which the dump-requests option enables
+// independently of the log level.
+func dumpf(format string, args ...any) {
+	log.Printf("DUMP "+format, args...)
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	eventLogSequentialRead uint32 = 0x0001
+	eventLogBackwardsRead  uint32 = 0x0008
+	// eventLogRecordSize is the size of the fixed part of an EVENTLOGRECORD,
+	// followed by the source name.
+	eventLogRecordSize int = 56
+)
+
+var (
+	advapi32          = windows.NewLazySystemDLL("advapi32.dll")
+	procOpenEventLog  = advapi32.NewProc("OpenEventLogW")
+	procReadEventLog  = advapi32.NewProc("ReadEventLogW")
+	procCloseEventLog = advapi32.NewProc("CloseEventLog")
+)
+
+// eventRecord is an entry of the event log.
+type eventRecord struct {
+	time      time.Time
+	eventType uint16
+	source    string
+	strings   []string
+}
+
+type logsCommand struct {
+	count int
+	cli   *flag.FlagSet
+}
+
+func newLogsCommand() *logsCommand {
+	result := &logsCommand{}
+	result.cli = flag.NewFlagSet(result.Name(), flag.ExitOnError)
+	result.cli.IntVar(&result.count, "count", 20, "number of entries to print")
+	return result
+}
+
+func (cmd *logsCommand) Name() string {
+	return "logs"
+}
+
+func (cmd *logsCommand) Desc() string {
+	return "Print the latest entries of the Windows service event log."
+}
+
+func (cmd *logsCommand) PrintUsage() {
+	cmd.cli.Usage()
+}
+
+// utf16At decodes the null-terminated UTF-16 string at offset of data, and
+// returns it along with the offset following it.
+func utf16At(data []byte, offset int) (string, int) {
+	chars := []uint16{}
+	for offset+1 < len(data) {
+		c := binary.LittleEndian.Uint16(data[offset:])
+		offset += 2
+		if c == 0 {
+			break
+		}
+		chars = append(chars, c)
+	}
+	return windows.UTF16ToString(chars), offset
+}
+
+// parseEventRecord decodes an EVENTLOGRECORD.
+func parseEventRecord(data []byte) eventRecord {
+	result := eventRecord{
+		time:      time.Unix(int64(binary.LittleEndian.Uint32(data[12:])), 0),
+		eventType: binary.LittleEndian.Uint16(data[24:]),
+	}
+	result.source, _ = utf16At(data, eventLogRecordSize)
+	count := int(binary.LittleEndian.Uint16(data[26:]))
+	offset := int(binary.LittleEndian.Uint32(data[36:]))
+	for i := 0; i < count; i++ {
+		var s string
+		s, offset = utf16At(data, offset)
+		result.strings = append(result.strings, s)
+	}
+	return result
+}
+
+// readEventLog returns the latest count records of the service event source,
+// from the most recent one.
+func readEventLog(count int) ([]eventRecord, error) {
+	source, err := windows.UTF16PtrFromString(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	handle, _, err := procOpenEventLog.Call(0, uintptr(unsafe.Pointer(source)))
+	if handle == 0 {
+		return nil, fmt.Errorf("Cannot open the event log: %w", err)
+	}
+	defer procCloseEventLog.Call(handle)
+	result := []eventRecord{}
+	buffer := make([]byte, 64*1024)
+	for len(result) < count {
+		var read, needed uint32
+		ok, _, err := procReadEventLog.Call(handle, uintptr(eventLogSequentialRead|eventLogBackwardsRead), 0,
+			uintptr(unsafe.Pointer(&buffer[0])), uintptr(len(buffer)), uintptr(unsafe.Pointer(&read)), uintptr(unsafe.Pointer(&needed)))
+		if ok == 0 {
+			if err == windows.ERROR_HANDLE_EOF {
+				break
+			}
+			if err == windows.ERROR_INSUFFICIENT_BUFFER {
+				buffer = make([]byte, needed)
+				continue
+			}
+			return nil, fmt.Errorf("Cannot read the event log: %w", err)
+		}
+		for offset := 0; offset+eventLogRecordSize <= int(read) && len(result) < count; {
+			length := int(binary.LittleEndian.Uint32(buffer[offset:]))
+			if length < eventLogRecordSize || offset+length > int(read) {
+				break
+			}
+			record := parseEventRecord(buffer[offset : offset+length])
+			if record.source == serviceName {
+				result = append(result, record)
+			}
+			offset += length
+		}
+	}
+	return result, nil
+}
+
+func (cmd *logsCommand) Run(args []string) error {
+	cmd.cli.Parse(args)
+	if cmd.cli.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Unknown argument", cmd.cli.Arg(0))
+		cmd.cli.SetOutput(os.Stderr)
+		cmd.cli.Usage()
+		os.Exit(1)
+	}
+	records, err := readEventLog(cmd.count)
+	if err != nil {
+		return err
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		level := "INFO"
+		switch records[i].eventType {
+		case windows.EVENTLOG_ERROR_TYPE:
+			level = "ERROR"
+		case windows.EVENTLOG_WARNING_TYPE:
+			level = "WARN"
+		}
+		message := ""
+		if len(records[i].strings) > 0 {
+			message = records[i].strings[0]
+		}
+		fmt.Println(records[i].time.Format("2006/01/02 15:04:05"), level, message)
+	}
+	return nil
+}
@@ -21,10 +21,12 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 const version string = "1.1.1"
@@ -52,24 +54,59 @@ type command interface {
 	Run([]string) error
 }
 
-type versionCommand struct{}
+type versionCommand struct {
+	server  string
+	token   string
+	timeout time.Duration
+	cli     *flag.FlagSet
+}
+
+func newVersionCommand() *versionCommand {
+	result := &versionCommand{}
+	result.cli = flag.NewFlagSet(result.Name(), flag.ExitOnError)
+	result.cli.StringVar(&result.server, "server", "", "URL of a running server to query (optional)")
+	result.cli.StringVar(&result.token, "admin-token", "", "admin token of the queried server")
+	result.cli.DurationVar(&result.timeout, "timeout", 10*time.Second, "maximum duration of the query of the server")
+	return result
+}
 
-func (cmd versionCommand) Name() string {
+func (cmd *versionCommand) Name() string {
 	return "version"
 }
 
-func (cmd versionCommand) Desc() string {
+func (cmd *versionCommand) Desc() string {
 	return "Print the application version."
 }
 
-func (cmd versionCommand) PrintUsage() {}
+func (cmd *versionCommand) PrintUsage() {
+	cmd.cli.Usage()
+}
 
-func (cmd versionCommand) Run(args []string) error {
+func (cmd *versionCommand) Run(args []string) error {
+	cmd.cli.Parse(args)
 	fmt.Println(filepath.Base(os.Args[0]), "version", version)
+	if cmd.server == "" {
+		return nil
+	}
+	stats, err := fetchStats(cmd.server, cmd.token, cmd.timeout)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Server version:", stats.Version)
+	fmt.Println("Uptime:", time.Duration(stats.Uptime*float64(time.Second)).Round(time.Second))
+	fmt.Println("Requests:", stats.Requests)
+	fmt.Println("Bytes served:", stats.BytesServed)
+	fmt.Println("Connections:", stats.Connections, "total,", stats.ActiveConnections, "active")
+	for _, cache := range stats.Caches {
+		fmt.Printf("Cache %s: %d hits, %d misses, %d evictions, %d bytes\n", cache.Name, cache.Hits, cache.Misses, cache.Evictions, cache.Size)
+	}
+	for _, route := range stats.Routes {
+		fmt.Printf("Route %s: %d requests, %d bytes served since %s\n", route.Route, route.Requests, route.BytesServed, stats.RoutesSince.Format(time.RFC3339))
+	}
 	return nil
 }
 
-var commands []command = []command{versionCommand{}, newServeCommand()}
+var commands []command = []command{newVersionCommand(), newServeCommand(), newPingUpstreamCommand(), newValidateIndexCommand(), newVerifyCommand(), newCheckUpdateCommand(), newBenchServeCommand(), newCacheRepairCommand(), newCheckConfigCommand()}
 
 func usage(w io.Writer, name string) {
 	fmt.Fprintf(w, "Usage: %s COMMAND [OPTIONS...]\nAvailable commands:\n", name)
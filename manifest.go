@@ -0,0 +1,125 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const coreSuffix string = "_libretro"
+
+// coreEntry describes a core of the manifest.
+type coreEntry struct {
+	Name     string            `json:"name"`
+	Path     string            `json:"path"`
+	Size     int64             `json:"size"`
+	Modified time.Time         `json:"modified"`
+	Version  string            `json:"version,omitempty"`
+	Info     map[string]string `json:"info,omitempty"`
+}
+
+// isCoreFile tells whether a file name is the one of a core, such as
+// fceumm_libretro.so or fceumm_libretro.dll.zip.
+func isCoreFile(name string) bool {
+	return strings.Contains(name, coreSuffix) && path.Ext(name) != ".info"
+}
+
+// coreName returns the core name of a core file name, such as fceumm_libretro.
+func coreName(name string) string {
+	return name[:strings.Index(name, coreSuffix)+len(coreSuffix)]
+}
+
+// parseCoreInfo reads a core .info file made of KEY = "VALUE" lines.
+func parseCoreInfo(r io.Reader) (map[string]string, error) {
+	result := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		result[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), "\"")
+	}
+	return result, scanner.Err()
+}
+
+// readCoreInfo returns the content of the sidecar .info file of a core, or nil
+// if there is none.
+func (filesystem *fileSystem) readCoreInfo(dir, name string) (map[string]string, error) {
+	file, err := filesystem.Source.Open(path.Join(dir, coreName(name)+".info"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseCoreInfo(file)
+}
+
+// coreManifest lists the cores available in the root directory and in its
+// subdirectories, along with the content of their .info files.
+func (filesystem *fileSystem) coreManifest() (http.File, error) {
+	entries := []coreEntry{}
+	dirs := []string{"/"}
+	for i := 0; i < len(dirs); i++ {
+		files, err := filesystem.readDir(dirs[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range files {
+			if info.IsDir() && i == 0 {
+				dirs = append(dirs, path.Join("/", info.Name()))
+			}
+			if !info.Mode().IsRegular() || !isCoreFile(info.Name()) {
+				continue
+			}
+			coreInfo, err := filesystem.readCoreInfo(dirs[i], info.Name())
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, coreEntry{
+				Name:     coreName(info.Name()),
+				Path:     strings.TrimPrefix(path.Join(dirs[i], info.Name()), "/"),
+				Size:     info.Size(),
+				Modified: info.ModTime(),
+				Version:  coreInfo["display_version"],
+				Info:     coreInfo,
+			})
+		}
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+	return inMemoryFile{strings.NewReader(string(data)), ".manifest.json"}, nil
+}
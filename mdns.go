@@ -0,0 +1,292 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The mDNS advertisement implements the subset of RFC 6762 and RFC 6763
+// needed to answer the queries of the service, without any dependency.
+const (
+	mdnsService  string = "_retroarch-assets._tcp.local."
+	mdnsTypeA    uint16 = 1
+	mdnsTypePTR  uint16 = 12
+	mdnsTypeTXT  uint16 = 16
+	mdnsTypeAAAA uint16 = 28
+	mdnsTypeSRV  uint16 = 33
+	mdnsTypeANY  uint16 = 255
+	mdnsClassIN  uint16 = 1
+	// mdnsCacheFlush marks the records which are unique to this host.
+	mdnsCacheFlush uint16 = 0x8000
+	mdnsHostTTL    uint32 = 120
+	mdnsServiceTTL uint32 = 4500
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// advertiser answers the mDNS queries of the service on the local network.
+type advertiser struct {
+	conn     *net.UDPConn
+	instance string
+	host     string
+	port     int
+	ips      []net.IP
+	done     sync.WaitGroup
+}
+
+// advertise starts advertising the service of the first listener.
+func advertise(listeners []net.Listener) (*advertiser, error) {
+	addr, ok := listeners[0].Addr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("Cannot advertise listener %s", listeners[0].Addr())
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	hostname, _, _ = strings.Cut(hostname, ".")
+	ips := []net.IP{}
+	unspecified := false
+	for _, listener := range listeners {
+		if a, ok := listener.Addr().(*net.TCPAddr); ok && a.IP.IsUnspecified() {
+			unspecified = true
+		} else if ok && !a.IP.IsLoopback() {
+			ips = append(ips, a.IP)
+		}
+	}
+	if unspecified {
+		local, err := localIPs()
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, local...)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("No listening address is reachable from the local network")
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return nil, err
+	}
+	ad := &advertiser{
+		conn:     conn,
+		instance: hostname + "." + mdnsService,
+		host:     hostname + ".local.",
+		port:     addr.Port,
+		ips:      ips,
+	}
+	ad.done.Add(1)
+	go ad.run()
+	return ad, nil
+}
+
+// localIPs returns the addresses of the interfaces reachable by multicast.
+func localIPs() ([]net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	result := []net.IP{}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+				result = append(result, ipNet.IP)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (ad *advertiser) run() {
+	defer ad.done.Done()
+	// Announce the service twice at startup, as advised by RFC 6762.
+	ad.conn.WriteToUDP(ad.response(0, ad.instance, mdnsTypeANY, false), mdnsGroup)
+	time.AfterFunc(time.Second, func() {
+		ad.conn.WriteToUDP(ad.response(0, ad.instance, mdnsTypeANY, false), mdnsGroup)
+	})
+	buffer := make([]byte, 9000)
+	for {
+		n, src, err := ad.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		ad.answer(buffer[:n], src)
+	}
+}
+
+// answer replies to the questions of a query about the service.
+func (ad *advertiser) answer(msg []byte, src *net.UDPAddr) {
+	if len(msg) < 12 || msg[2]&0x80 != 0 {
+		return
+	}
+	id := binary.BigEndian.Uint16(msg)
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	offset := 12
+	for i := 0; i < questions; i++ {
+		name, next, err := readName(msg, offset)
+		if err != nil || next+4 > len(msg) {
+			return
+		}
+		qtype := binary.BigEndian.Uint16(msg[next:])
+		offset = next + 4
+		if !strings.EqualFold(name, mdnsService) && !strings.EqualFold(name, ad.instance) && !strings.EqualFold(name, ad.host) {
+			continue
+		}
+		if src.Port != mdnsGroup.Port {
+			// Legacy unicast query: reply directly with the query identifier.
+			ad.conn.WriteToUDP(ad.response(id, name, qtype, false), src)
+		} else {
+			ad.conn.WriteToUDP(ad.response(0, name, qtype, false), mdnsGroup)
+		}
+		return
+	}
+}
+
+// response builds the answer to a question about name. All the records of the
+// service are provided, the ones not asked being additional records. With
+// goodbye, the records have a null TTL to withdraw them.
+func (ad *advertiser) response(id uint16, name string, qtype uint16, goodbye bool) []byte {
+	ttl := func(value uint32) uint32 {
+		if goodbye {
+			return 0
+		}
+		return value
+	}
+	type record struct {
+		name  string
+		rtype uint16
+		class uint16
+		ttl   uint32
+		data  []byte
+	}
+	srv := binary.BigEndian.AppendUint16(make([]byte, 4), uint16(ad.port))
+	txt := "version=" + version
+	records := []record{
+		{mdnsService, mdnsTypePTR, mdnsClassIN, ttl(mdnsServiceTTL), appendName(nil, ad.instance)},
+		{ad.instance, mdnsTypeSRV, mdnsClassIN | mdnsCacheFlush, ttl(mdnsHostTTL), appendName(srv, ad.host)},
+		{ad.instance, mdnsTypeTXT, mdnsClassIN | mdnsCacheFlush, ttl(mdnsServiceTTL), append([]byte{byte(len(txt))}, txt...)},
+	}
+	for _, ip := range ad.ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			records = append(records, record{ad.host, mdnsTypeA, mdnsClassIN | mdnsCacheFlush, ttl(mdnsHostTTL), ip4})
+		} else {
+			records = append(records, record{ad.host, mdnsTypeAAAA, mdnsClassIN | mdnsCacheFlush, ttl(mdnsHostTTL), ip.To16()})
+		}
+	}
+	answers, additionals := []record{}, []record{}
+	for _, r := range records {
+		if strings.EqualFold(r.name, name) && (qtype == mdnsTypeANY || qtype == r.rtype) {
+			answers = append(answers, r)
+		} else {
+			additionals = append(additionals, r)
+		}
+	}
+	if len(answers) == 0 {
+		answers, additionals = additionals, nil
+	}
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = binary.BigEndian.AppendUint16(msg, 0x8400)
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(answers)))
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(additionals)))
+	for _, r := range append(answers, additionals...) {
+		msg = appendName(msg, r.name)
+		msg = binary.BigEndian.AppendUint16(msg, r.rtype)
+		msg = binary.BigEndian.AppendUint16(msg, r.class)
+		msg = binary.BigEndian.AppendUint32(msg, r.ttl)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(r.data)))
+		msg = append(msg, r.data...)
+	}
+	return msg
+}
+
+// withdraw tells the clients that the service is not available anymore.
+func (ad *advertiser) withdraw() {
+	ad.conn.WriteToUDP(ad.response(0, ad.instance, mdnsTypeANY, true), mdnsGroup)
+}
+
+// Close stops answering the queries. The advertisement is not withdrawn, so
+// that a restarted server keeps being advertised.
+func (ad *advertiser) Close() error {
+	err := ad.conn.Close()
+	ad.done.Wait()
+	return err
+}
+
+// appendName appends the DNS encoding of a fully qualified name.
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// readName decodes the name at offset of a DNS message, following the
+// compression pointers, and returns it with the offset following it.
+func readName(msg []byte, offset int) (string, int, error) {
+	labels := []string{}
+	end := -1
+	for jumps := 0; jumps < 16; {
+		if offset >= len(msg) {
+			break
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(msg) {
+				return "", 0, fmt.Errorf("Truncated name")
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3fff)
+			jumps++
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, fmt.Errorf("Truncated name")
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+	return "", 0, fmt.Errorf("Invalid name")
+}
@@ -0,0 +1,323 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// responseRecorder wraps a response writer to record the status code and the
+// number of bytes written.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the sendfile optimization of the wrapped writer.
+func (rec *responseRecorder) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := rec.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(rec.ResponseWriter, r)
+	}
+	rec.bytes += n
+	return n, err
+}
+
+func (rec *responseRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// requireToken rejects the requests which do not provide the token as a bearer
+// authorization.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		provided := strings.TrimPrefix(authorization, "Bearer ")
+		if provided == authorization || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseUserAgentPatterns compiles the regular expressions of the blocked user
+// agents.
+func parseUserAgentPatterns(exprs []string) ([]*regexp.Regexp, error) {
+	patterns := []*regexp.Regexp{}
+	for _, expr := range exprs {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid user agent pattern %s: %w", expr, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// blockUserAgents rejects with a 403 Forbidden status the requests whose
+// User-Agent header matches one of the patterns.
+func blockUserAgents(patterns []*regexp.Regexp, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent := r.UserAgent()
+		for _, pattern := range patterns {
+			if pattern.MatchString(userAgent) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowMethods rejects with a 405 Method Not Allowed status the requests whose
+// method is not one of methods. The /admin/ endpoints check their methods
+// themselves.
+func allowMethods(methods []string, next http.Handler) http.Handler {
+	allowed := map[string]bool{}
+	for _, method := range methods {
+		allowed[method] = true
+	}
+	allow := strings.Join(methods, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowed[r.Method] && !strings.HasPrefix(r.URL.Path, "/admin/") {
+			w.Header().Set("Allow", allow)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// connKey is the context key of the connection of a request.
+type connKey struct{}
+
+// withConn stores the connection in the context of its requests, as the
+// ConnContext function of the server.
+func withConn(ctxt context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctxt, connKey{}, conn)
+}
+
+// extendWriteDeadline gives timeout to the download requests to write their
+// response, instead of the write timeout of the server. The directory listings
+// and the generated files, whose name starts with a dot, are not downloads.
+// Only the HTTP/1 requests are extended: an HTTP/2 connection is shared by
+// concurrent streams, which have their own deadlines.
+func extendWriteDeadline(timeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Base(r.URL.Path)
+		if conn, ok := r.Context().Value(connKey{}).(net.Conn); ok && r.ProtoMajor == 1 && !strings.HasSuffix(r.URL.Path, "/") && !strings.HasPrefix(name, ".") {
+			conn.SetWriteDeadline(time.Now().Add(timeout))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// versionHeader adds the version of the server to the responses.
+func versionHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RAAS-Version", version)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errorPage is a page served instead of the body of an error response.
+type errorPage struct {
+	contentType string
+	body        []byte
+}
+
+// errorPages maps status codes to their pages.
+type errorPages map[int]*errorPage
+
+// parseErrorPage parses a CODE=PATH specification.
+func parseErrorPage(spec string) (int, string, error) {
+	code, name, found := strings.Cut(spec, "=")
+	status, err := strconv.Atoi(code)
+	if !found || err != nil || status < 400 || status > 599 {
+		return 0, "", fmt.Errorf("Invalid error page %s: expected CODE=PATH with CODE between 400 and 599", spec)
+	}
+	return status, name, nil
+}
+
+// loadErrorPages reads the pages of CODE=PATH specifications.
+func loadErrorPages(specs []string) (errorPages, error) {
+	result := errorPages{}
+	for _, spec := range specs {
+		status, name, err := parseErrorPage(spec)
+		if err != nil {
+			return nil, err
+		}
+		body, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		contentType := mime.TypeByExtension(filepath.Ext(name))
+		if contentType == "" {
+			contentType = http.DetectContentType(body)
+		}
+		result[status] = &errorPage{contentType: contentType, body: body}
+	}
+	return result, nil
+}
+
+// middleware replaces the body of the responses of next whose status has a
+// page.
+func (pages errorPages) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&errorPageWriter{ResponseWriter: w, pages: pages, head: r.Method == http.MethodHead}, r)
+	})
+}
+
+// errorPageWriter writes the error page of the status instead of the body
+// provided by the handler.
+type errorPageWriter struct {
+	http.ResponseWriter
+	pages       errorPages
+	head        bool
+	wroteHeader bool
+	intercepted bool
+}
+
+func (ew *errorPageWriter) WriteHeader(status int) {
+	if ew.wroteHeader {
+		return
+	}
+	ew.wroteHeader = true
+	page, found := ew.pages[status]
+	if !found {
+		ew.ResponseWriter.WriteHeader(status)
+		return
+	}
+	ew.intercepted = true
+	header := ew.Header()
+	header.Del("Content-Encoding")
+	header.Set("Content-Type", page.contentType)
+	header.Set("Content-Length", strconv.Itoa(len(page.body)))
+	ew.ResponseWriter.WriteHeader(status)
+	if !ew.head {
+		ew.ResponseWriter.Write(page.body)
+	}
+}
+
+func (ew *errorPageWriter) Write(p []byte) (int, error) {
+	if !ew.wroteHeader {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.intercepted {
+		return len(p), nil
+	}
+	return ew.ResponseWriter.Write(p)
+}
+
+func (ew *errorPageWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !ew.wroteHeader {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.intercepted {
+		return io.Copy(io.Discard, r)
+	}
+	if rf, ok := ew.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(ew.ResponseWriter, r)
+}
+
+func (ew *errorPageWriter) Flush() {
+	if flusher, ok := ew.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (ew *errorPageWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+// redactedHeaders are the request headers whose values are hidden from the
+// request dumps.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// dumpRequests logs the request line and the headers of each request handled
+// by next, redacting the credentials.
+func dumpRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Clone()
+		for _, name := range redactedHeaders {
+			if _, found := header[name]; found {
+				header.Set(name, "[REDACTED]")
+			}
+		}
+		names := make([]string, 0, len(header))
+		for name := range header {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		dump := strings.Builder{}
+		fmt.Fprintf(&dump, "Request from %s:\n%s %s %s\nHost: %s\n", r.RemoteAddr, r.Method, r.RequestURI, r.Proto, r.Host)
+		for _, name := range names {
+			for _, value := range header[name] {
+				fmt.Fprintf(&dump, "%s: %s\n", name, value)
+			}
+		}
+		dumpf("%s", dump.String())
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+type pingUpstreamCommand struct {
+	timeout time.Duration
+	cli     *flag.FlagSet
+}
+
+func newPingUpstreamCommand() *pingUpstreamCommand {
+	result := &pingUpstreamCommand{}
+	result.cli = flag.NewFlagSet(result.Name(), flag.ExitOnError)
+	result.cli.Usage = func() {
+		fmt.Fprintf(result.cli.Output(), "Usage: %s %s [OPTIONS...] [MIRROR_URL...]\n", os.Args[0], result.Name())
+		result.cli.PrintDefaults()
+	}
+	result.cli.DurationVar(&result.timeout, "timeout", 10*time.Second, "maximum duration of each request")
+	return result
+}
+
+func (cmd *pingUpstreamCommand) Name() string {
+	return "ping-upstream"
+}
+
+func (cmd *pingUpstreamCommand) Desc() string {
+	return "Check that the upstream server and the provided mirrors can be reached."
+}
+
+func (cmd *pingUpstreamCommand) PrintUsage() {
+	cmd.cli.Usage()
+}
+
+// ping issues a HEAD request to target and returns the response status with
+// the time taken to receive the response headers.
+func (cmd *pingUpstreamCommand) ping(target string) (string, time.Duration, error) {
+	client := &http.Client{Timeout: cmd.timeout}
+	start := time.Now()
+	resp, err := client.Head(target)
+	if err != nil {
+		return "", 0, err
+	}
+	resp.Body.Close()
+	return resp.Status, time.Since(start), nil
+}
+
+func (cmd *pingUpstreamCommand) Run(args []string) error {
+	cmd.cli.Parse(args)
+	targets := append([]string{retroarchHost}, cmd.cli.Args()...)
+	failures := 0
+	for _, target := range targets {
+		status, latency, err := cmd.ping(target)
+		if err != nil {
+			fmt.Printf("%s: %s\n", target, err)
+			failures++
+			continue
+		}
+		fmt.Printf("%s: %s in %s\n", target, status, latency.Round(time.Millisecond))
+	}
+	if failures > 0 {
+		return fmt.Errorf("%d of %d hosts could not be reached", failures, len(targets))
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// preloadCheckInterval is the minimum duration between two checks of the
+// modification time of a preloaded file.
+const preloadCheckInterval time.Duration = time.Second
+
+// preloadedEntry is the content of a file kept in memory.
+type preloadedEntry struct {
+	mutex     sync.Mutex
+	data      []byte
+	info      fs.FileInfo
+	lastCheck time.Time
+}
+
+// preloadedFile is an open preloaded file.
+type preloadedFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f preloadedFile) Close() error {
+	return nil
+}
+
+func (f preloadedFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, fmt.Errorf("%s is not a directory", f.info.Name())
+}
+
+func (f preloadedFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// preloadSource serves some files of a source from memory. They are read
+// again when their modification time or size changes.
+type preloadSource struct {
+	http.FileSystem
+	files map[string]*preloadedEntry
+}
+
+// newPreloadSource preloads the files of source matching the patterns, which
+// are URL paths relative to root where each element may be a shell pattern.
+func newPreloadSource(source http.FileSystem, root string, patterns []string) (*preloadSource, error) {
+	result := &preloadSource{FileSystem: source, files: map[string]*preloadedEntry{}}
+	for _, pattern := range patterns {
+		if !strings.HasPrefix(pattern, root) {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern %q: %w", pattern, err)
+		}
+		names, err := expandPattern(source, "/", strings.Split(strings.TrimPrefix(pattern, root), "/"))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			entry := &preloadedEntry{}
+			if err := entry.load(source, name); err != nil {
+				return nil, err
+			}
+			result.files[name] = entry
+		}
+	}
+	return result, nil
+}
+
+// expandPattern returns the regular files of source below dir matching the
+// pattern elements.
+func expandPattern(source http.FileSystem, dir string, elements []string) ([]string, error) {
+	d, err := source.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := d.Readdir(0)
+	d.Close()
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, info := range files {
+		if matched, _ := path.Match(elements[0], info.Name()); !matched {
+			continue
+		}
+		name := path.Join(dir, info.Name())
+		if len(elements) > 1 && info.IsDir() {
+			names, err := expandPattern(source, name, elements[1:])
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, names...)
+		} else if len(elements) == 1 && info.Mode().IsRegular() {
+			result = append(result, name)
+		}
+	}
+	return result, nil
+}
+
+// load reads the file name of source. The mutex must be held, unless the
+// entry is not shared yet.
+func (entry *preloadedEntry) load(source http.FileSystem, name string) error {
+	file, err := source.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	entry.data, entry.info, entry.lastCheck = data, info, time.Now()
+	return nil
+}
+
+// revalidate reloads the entry if its file changed since it was read.
+func (entry *preloadedEntry) revalidate(source http.FileSystem, name string) error {
+	if time.Since(entry.lastCheck) < preloadCheckInterval {
+		return nil
+	}
+	file, err := source.Open(name)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	file.Close()
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(entry.info.ModTime()) && info.Size() == entry.info.Size() {
+		entry.lastCheck = time.Now()
+		return nil
+	}
+	return entry.load(source, name)
+}
+
+func (source *preloadSource) Open(name string) (http.File, error) {
+	entry, found := source.files[path.Clean(name)]
+	if !found {
+		return source.FileSystem.Open(name)
+	}
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	if err := entry.revalidate(source.FileSystem, path.Clean(name)); err != nil {
+		return nil, err
+	}
+	return preloadedFile{bytes.NewReader(entry.data), entry.info}, nil
+}
@@ -0,0 +1,338 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// parseUpstreamURL parses the URL of the upstream server, which must be an
+// absolute HTTP or HTTPS URL.
+func parseUpstreamURL(location string) (*url.URL, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid upstream URL %s: %w", location, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid upstream URL %s: expected http://HOST/PATH or https://HOST/PATH", location)
+	}
+	return u, nil
+}
+
+// rewriteRule replaces the path of the proxied requests matching pattern with
+// the path of the upstream server built from replacement.
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// parseRewriteRules parses REGEXP=REPLACEMENT rules.
+func parseRewriteRules(values []string) ([]rewriteRule, error) {
+	result := []rewriteRule{}
+	for _, value := range values {
+		expr, replacement, found := strings.Cut(value, "=")
+		if !found || !strings.HasPrefix(replacement, "/") {
+			return nil, fmt.Errorf("Invalid upstream rewrite rule %s: expected REGEXP=/PATH", value)
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid upstream rewrite rule %s: %w", value, err)
+		}
+		result = append(result, rewriteRule{pattern, replacement})
+	}
+	return result, nil
+}
+
+// rewritePath returns the upstream path of the first rule matching name, with
+// the $N references replaced by the submatches, or false if no rule matches.
+func rewritePath(rules []rewriteRule, name string) (string, bool) {
+	for _, rule := range rules {
+		if match := rule.pattern.FindStringSubmatchIndex(name); match != nil {
+			return string(rule.pattern.ExpandString(nil, rule.replacement, name, match)), true
+		}
+	}
+	return "", false
+}
+
+// upstreamHeader is a header added to the requests of the route root
+// forwarded to the upstream server, such as an API key.
+type upstreamHeader struct {
+	root  string
+	name  string
+	value string
+}
+
+// parseUpstreamHeaders parses the NAME: VALUE headers of the route root. A
+// @PATH value is read from the file PATH, without its trailing line break, so
+// that the secrets are not visible on the command line.
+func parseUpstreamHeaders(root string, values []string) ([]upstreamHeader, error) {
+	result := []upstreamHeader{}
+	for _, value := range values {
+		name, content, found := strings.Cut(value, ":")
+		name, content = strings.TrimSpace(name), strings.TrimSpace(content)
+		if !found || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("Invalid upstream header %s: expected NAME: VALUE or NAME: @PATH", value)
+		}
+		if strings.HasPrefix(content, "@") {
+			data, err := os.ReadFile(content[1:])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid upstream header %s: %w", name, err)
+			}
+			content = strings.TrimRight(string(data), "\r\n")
+		}
+		if strings.ContainsAny(content, "\r\n") {
+			return nil, fmt.Errorf("Invalid upstream header %s: the value contains a line break", name)
+		}
+		result = append(result, upstreamHeader{root, http.CanonicalHeaderKey(name), content})
+	}
+	return result, nil
+}
+
+// isCacheable tells whether the response of a request can be stored in or
+// served from the cache.
+func isCacheable(req *http.Request) bool {
+	return (req.Method == http.MethodGet || req.Method == http.MethodHead) && req.Header.Get("Range") == ""
+}
+
+// cacheKey is the context key of the cache entry of a proxied request.
+type cacheKey struct{}
+
+// cacheEntryRef is the cache and the key of the entry of a proxied request.
+type cacheEntryRef struct {
+	cache *diskCache
+	key   string
+}
+
+// gzipAccepted is the context key set when the client of a proxied request
+// accepts gzip encoded responses.
+type gzipAccepted struct{}
+
+// markGzipAccepted sets the gzipAccepted context key of the requests whose
+// client accepts gzip.
+func markGzipAccepted(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if acceptsGzip(r) {
+			r = r.WithContext(context.WithValue(r.Context(), gzipAccepted{}, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cachingProxy serves the requests from the cache of their route when
+// possible, and forwards them to the reverse proxy otherwise.
+type cachingProxy struct {
+	caches     cacheSet
+	proxy      http.Handler
+	keyQuery   bool
+	keyHeaders []string
+	// serveStale serves the cached responses older than the TTL when the
+	// upstream server fails.
+	serveStale bool
+}
+
+// staleWriter serves the cached response of a request, even if it is older
+// than the TTL, instead of an error response of the upstream server.
+type staleWriter struct {
+	http.ResponseWriter
+	r     *http.Request
+	cache *diskCache
+	key   string
+	// served is set once the cached response is served, the response of the
+	// upstream server being discarded.
+	served bool
+}
+
+func (sw *staleWriter) WriteHeader(status int) {
+	if status >= http.StatusInternalServerError && sw.cache.serveStale(sw.ResponseWriter, sw.r, sw.key) {
+		warnf("Upstream server failed with status %d, served the cached %s", status, sw.r.URL.RequestURI())
+		sw.served = true
+		return
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *staleWriter) Write(p []byte) (int, error) {
+	if sw.served {
+		return len(p), nil
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *staleWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok && !sw.served {
+		flusher.Flush()
+	}
+}
+
+// requestCacheKey returns the cache key of a request: its path, followed by
+// its query string when keyQuery is set, with the parameters sorted, and by
+// the values of the keyHeaders headers.
+func requestCacheKey(r *http.Request, keyQuery bool, keyHeaders []string) string {
+	key := r.URL.Path
+	if keyQuery && r.URL.RawQuery != "" {
+		key += "?" + r.URL.Query().Encode()
+	}
+	for _, name := range keyHeaders {
+		key += "\n" + http.CanonicalHeaderKey(name) + ": " + strings.Join(r.Header.Values(name), ", ")
+	}
+	return key
+}
+
+// key returns the cache key of a request.
+func (cp *cachingProxy) key(r *http.Request) string {
+	return requestCacheKey(r, cp.keyQuery, cp.keyHeaders)
+}
+
+func (cp *cachingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if cache := cp.caches.get(r.URL.Path); cache != nil && isCacheable(r) {
+		key := cp.key(r)
+		if r.Context().Value(gzipAccepted{}) != nil {
+			gw := &gzipResponseWriter{ResponseWriter: w, name: r.URL.Path}
+			defer gw.Close()
+			w = gw
+		}
+		if cache.serve(w, r, key) {
+			debugf("Served %s from the cache", r.URL.RequestURI())
+			return
+		}
+		debugf("Forwarding %s to the upstream server", r.URL.RequestURI())
+		if cp.serveStale {
+			w = &staleWriter{ResponseWriter: w, r: r, cache: cache, key: key}
+		}
+		r = r.WithContext(context.WithValue(r.Context(), cacheKey{}, &cacheEntryRef{cache, key}))
+	}
+	cp.proxy.ServeHTTP(w, r)
+}
+
+// limitDuration cancels the requests forwarded to next after maxDuration.
+func limitDuration(maxDuration time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctxt, cancel := context.WithTimeout(r.Context(), maxDuration)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctxt))
+	})
+}
+
+// limitConcurrency queues the requests to next beyond maxConcurrent ones,
+// until a request completes or they are canceled.
+func limitConcurrency(maxConcurrent int, next http.Handler) http.Handler {
+	slots := make(chan struct{}, maxConcurrent)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+		case <-r.Context().Done():
+			proxyErrorHandler(w, r, r.Context().Err())
+			return
+		}
+		defer func() { <-slots }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	errorf("Proxy error: %v", err)
+	if errors.Is(err, context.DeadlineExceeded) {
+		w.WriteHeader(http.StatusGatewayTimeout)
+	} else {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// newReverseProxy returns the handler forwarding the requests to the upstream
+// server, and its HEAD cache, nil when disabled.
+func newReverseProxy(target *url.URL, opts *serverOptions, caches cacheSet, buffers *copyBufferPool, rules []rewriteRule, headers []upstreamHeader) (http.Handler, *headCache) {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ErrorHandler = proxyErrorHandler
+	if buffers != nil {
+		proxy.BufferPool = buffers
+	}
+	var transport http.RoundTripper = http.DefaultTransport
+	if opts.proxyMaxConns > 0 {
+		limited := http.DefaultTransport.(*http.Transport).Clone()
+		limited.MaxConnsPerHost = opts.proxyMaxConns
+		transport = limited
+	}
+	if opts.otelEndpoint != "" {
+		transport = &tracingTransport{transport}
+	}
+	proxy.Transport = transport
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		requested := req.URL.Path
+		rewritten, ok := rewritePath(rules, req.URL.Path)
+		director(req)
+		for _, header := range headers {
+			if strings.HasPrefix(requested, header.root) {
+				req.Header.Set(header.name, header.value)
+			}
+		}
+		if ok {
+			// The rewritten path replaces the one of the upstream URL
+			req.URL.Path, req.URL.RawPath = rewritten, ""
+		}
+		req.Host = target.Host
+		if req.Context().Value(cacheKey{}) != nil {
+			// Let the transport handle the compression so that the cached
+			// body is not encoded
+			req.Header.Del("Accept-Encoding")
+		}
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		ctxt := resp.Request.Context()
+		entry, _ := ctxt.Value(cacheKey{}).(*cacheEntryRef)
+		if entry != nil && resp.Request.Method == http.MethodGet && resp.StatusCode == http.StatusOK {
+			resp.Body = entry.cache.store(entry.key, resp)
+		}
+		if ctxt.Value(gzipAccepted{}) != nil && isCompressible(resp.Request.URL.Path, resp.StatusCode, resp.Header) {
+			setGzipHeaders(resp.Header)
+			resp.Body = newGzipBody(resp.Body)
+		}
+		return nil
+	}
+	var handler http.Handler = proxy
+	if opts.proxyMaxConns > 0 {
+		handler = limitConcurrency(opts.proxyMaxConns, handler)
+	}
+	if opts.proxyMaxDuration > 0 {
+		handler = limitDuration(opts.proxyMaxDuration, handler)
+	}
+	if len(caches) > 0 {
+		handler = &cachingProxy{caches: caches, proxy: handler, keyQuery: opts.cacheKeyQuery, keyHeaders: opts.cacheKeyHeaders, serveStale: opts.serveStale}
+	}
+	var heads *headCache
+	if opts.headCacheTTL > 0 {
+		heads = newHeadCache(opts.headCacheTTL, opts, handler)
+		handler = heads
+	}
+	if opts.proxyGzip {
+		handler = markGzipAccepted(handler)
+	}
+	return handler, heads
+}
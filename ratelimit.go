@@ -0,0 +1,98 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateBucket holds the requests a client can still issue.
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter rejects with a 429 Too Many Requests status the requests of the
+// clients which issued more than count requests during period. Each client
+// address has a bucket of count requests, refilled continuously.
+type rateLimiter struct {
+	count   int
+	period  time.Duration
+	mutex   sync.Mutex
+	buckets map[string]*rateBucket
+	swept   time.Time
+}
+
+func newRateLimiter(limit rateValue) *rateLimiter {
+	return &rateLimiter{count: limit.count, period: limit.period, buckets: map[string]*rateBucket{}, swept: time.Now()}
+}
+
+// allow consumes a request of the bucket of client and tells whether it was
+// available, or else the delay before it is.
+func (limiter *rateLimiter) allow(client string) (bool, time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(limiter.swept) > limiter.period {
+		// The buckets refilled since then are the same as missing ones
+		for key, bucket := range limiter.buckets {
+			if now.Sub(bucket.last) > limiter.period {
+				delete(limiter.buckets, key)
+			}
+		}
+		limiter.swept = now
+	}
+	bucket := limiter.buckets[client]
+	if bucket == nil {
+		bucket = &rateBucket{tokens: float64(limiter.count), last: now}
+		limiter.buckets[client] = bucket
+	}
+	rate := float64(limiter.count) / float64(limiter.period)
+	bucket.tokens += float64(now.Sub(bucket.last)) * rate
+	if bucket.tokens > float64(limiter.count) {
+		bucket.tokens = float64(limiter.count)
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / rate)
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+func (limiter *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		if ok, delay := limiter.allow(client); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int((delay+time.Second-1)/time.Second)))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,550 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// remoteClient requests the remote sources. Its timeouts bound the connection
+// and the wait for the response headers, not the download of the bodies.
+var remoteClient = newRemoteClient(30 * time.Second)
+
+// newRemoteClient returns a client whose dial, TLS handshake and response
+// header waits are limited to timeout, without limit when it is 0.
+func newRemoteClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = timeout
+	transport.ResponseHeaderTimeout = timeout
+	return &http.Client{Transport: transport}
+}
+
+// newRemoteSource returns the file system of an HTTP server exposing
+// buildbot-like .index files or of an S3 bucket.
+func newRemoteSource(location string) (http.FileSystem, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("Missing host in %s", location)
+	}
+	if u.Scheme == "s3" {
+		return http.FS(&remoteFS{newS3Store(u.Host, strings.Trim(u.Path, "/"))}), nil
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return http.FS(&remoteFS{&httpStore{u}}), nil
+}
+
+// remoteEntry describes an object or a directory of a remote store.
+type remoteEntry struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (e *remoteEntry) Name() string {
+	return e.name
+}
+
+func (e *remoteEntry) Size() int64 {
+	return e.size
+}
+
+func (e *remoteEntry) Mode() fs.FileMode {
+	if e.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (e *remoteEntry) ModTime() time.Time {
+	return e.modTime
+}
+
+func (e *remoteEntry) IsDir() bool {
+	return e.dir
+}
+
+func (e *remoteEntry) Sys() any {
+	return nil
+}
+
+func (e *remoteEntry) Type() fs.FileMode {
+	return e.Mode().Type()
+}
+
+func (e *remoteEntry) Info() (fs.FileInfo, error) {
+	return e, nil
+}
+
+// remoteStore is the protocol specific part of a remote file system.
+type remoteStore interface {
+	// request builds a request for the object with the provided name. An
+	// empty name targets the root of the store.
+	request(method, name string, query url.Values) (*http.Request, error)
+	// list returns the content of a directory, or fs.ErrNotExist if it does
+	// not exist.
+	list(dir string) ([]*remoteEntry, error)
+}
+
+// remoteFS is a read-only fs.FS on top of a remote store.
+type remoteFS struct {
+	store remoteStore
+}
+
+func (rfs *remoteFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name != "." {
+		info, err := rfs.stat(name)
+		if err == nil {
+			return &remoteFile{store: rfs.store, info: info, key: name}, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	entries, err := rfs.store.list(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &remoteDir{info: &remoteEntry{name: path.Base(name), dir: true}, entries: entries}, nil
+}
+
+func (rfs *remoteFS) stat(name string) (*remoteEntry, error) {
+	req, err := rfs.store.request(http.MethodHead, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fs.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+	if strings.HasSuffix(resp.Request.URL.Path, "/") {
+		// Redirected to a directory
+		return nil, fs.ErrNotExist
+	}
+	if resp.ContentLength < 0 {
+		return nil, fmt.Errorf("Unknown size")
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &remoteEntry{name: path.Base(name), size: resp.ContentLength, modTime: modTime}, nil
+}
+
+// remoteDir is an opened directory of a remote store.
+type remoteDir struct {
+	info    *remoteEntry
+	entries []*remoteEntry
+}
+
+func (d *remoteDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *remoteDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *remoteDir) Close() error {
+	return nil
+}
+
+func (d *remoteDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	n := len(d.entries)
+	if count > 0 && count < n {
+		n = count
+	}
+	if count > 0 && n == 0 {
+		return nil, io.EOF
+	}
+	result := make([]fs.DirEntry, n)
+	for i := range result {
+		result[i] = d.entries[i]
+	}
+	d.entries = d.entries[n:]
+	return result, nil
+}
+
+// remoteFile is an opened object of a remote store. The content is fetched
+// lazily with ranged requests, so that seeking does not download the object.
+type remoteFile struct {
+	store  remoteStore
+	info   *remoteEntry
+	key    string
+	offset int64
+	body   io.ReadCloser
+}
+
+func (f *remoteFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *remoteFile) Read(p []byte) (int, error) {
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		req, err := f.store.request(http.MethodGet, f.key, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", f.offset))
+		resp, err := remoteClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+		case http.StatusOK:
+			// Range not supported by the remote server
+			if _, err := io.CopyN(io.Discard, resp.Body, f.offset); err != nil {
+				resp.Body.Close()
+				return 0, err
+			}
+		default:
+			resp.Body.Close()
+			return 0, fmt.Errorf("Unexpected status %s", resp.Status)
+		}
+		f.body = resp.Body
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *remoteFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.key, Err: fs.ErrInvalid}
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *remoteFile) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+// httpStore is a remote store served by an HTTP server providing .index and
+// .index-dirs listings, such as buildbot or another instance of this server.
+type httpStore struct {
+	base *url.URL
+}
+
+func (store *httpStore) request(method, name string, query url.Values) (*http.Request, error) {
+	target := *store.base
+	target.Path = path.Join(target.Path, name)
+	if strings.HasSuffix(name, "/") {
+		target.Path += "/"
+	}
+	target.RawQuery = query.Encode()
+	return http.NewRequest(method, target.String(), nil)
+}
+
+func (store *httpStore) readLines(name string) ([]string, error) {
+	req, err := store.request(http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fs.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+	result := []string{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, indexFooterPrefix) {
+			result = append(result, line)
+		}
+	}
+	return result, scanner.Err()
+}
+
+func (store *httpStore) list(dir string) ([]*remoteEntry, error) {
+	if dir == "." {
+		dir = ""
+	}
+	files, err := store.readLines(path.Join(dir, ".index"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	found := err == nil
+	dirs, err := store.readLines(path.Join(dir, ".index-dirs"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if !found && err != nil {
+		return nil, fs.ErrNotExist
+	}
+	result := []*remoteEntry{}
+	for _, name := range dirs {
+		result = append(result, &remoteEntry{name: name, dir: true})
+	}
+	for _, name := range files {
+		result = append(result, &remoteEntry{name: name})
+	}
+	return result, nil
+}
+
+// s3Store is a remote store backed by an S3 compatible bucket. The endpoint
+// and credentials are read from the usual AWS environment variables. Without
+// credentials, requests are anonymous.
+type s3Store struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	pathStyle bool
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+}
+
+func newS3Store(bucket, prefix string) *s3Store {
+	store := &s3Store{
+		bucket:    bucket,
+		prefix:    prefix,
+		region:    os.Getenv("AWS_REGION"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if store.region == "" {
+		store.region = "us-east-1"
+	}
+	if endpoint, err := url.Parse(os.Getenv("AWS_ENDPOINT_URL")); err == nil && endpoint.Host != "" {
+		store.endpoint = endpoint
+		store.pathStyle = true
+	} else {
+		store.endpoint = &url.URL{Scheme: "https", Host: bucket + ".s3." + store.region + ".amazonaws.com"}
+	}
+	return store
+}
+
+func (store *s3Store) request(method, name string, query url.Values) (*http.Request, error) {
+	key := name
+	if key == "." {
+		key = ""
+	}
+	if store.prefix != "" && key != "" {
+		key = store.prefix + "/" + key
+	}
+	if store.pathStyle {
+		key = store.bucket + "/" + key
+	}
+	target := *store.endpoint
+	target.Path = "/" + key
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	target.RawPath = "/" + strings.Join(segments, "/")
+	target.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	req, err := http.NewRequest(method, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if store.accessKey != "" {
+		store.sign(req, time.Now().UTC())
+	}
+	return req, nil
+}
+
+// sign adds an AWS signature version 4 to the request.
+func (store *s3Store) sign(req *http.Request, now time.Time) {
+	store.signPayload(req, now, "UNSIGNED-PAYLOAD")
+}
+
+// signPayload adds an AWS signature version 4 to the request, covering the
+// payload through its hash, or UNSIGNED-PAYLOAD.
+func (store *s3Store) signPayload(req *http.Request, now time.Time, payloadHash string) {
+	date := now.Format("20060102")
+	timestamp := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", timestamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if store.token != "" {
+		req.Header.Set("X-Amz-Security-Token", store.token)
+	}
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if store.token != "" {
+		headers = append(headers, "x-amz-security-token")
+	}
+	canonicalHeaders := strings.Builder{}
+	for _, header := range headers {
+		value := req.Header.Get(header)
+		if header == "host" {
+			value = req.URL.Host
+		}
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", header, strings.TrimSpace(value))
+	}
+	signedHeaders := strings.Join(headers, ";")
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	canonicalQuery := make([]string, 0, len(keys))
+	for _, key := range keys {
+		canonicalQuery = append(canonicalQuery, s3Escape(key)+"="+s3Escape(query.Get(key)))
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + store.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + timestamp + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := []byte("AWS4" + store.secretKey)
+	for _, part := range []string{date, store.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", store.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3Escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (store *s3Store) list(dir string) ([]*remoteEntry, error) {
+	prefix := store.prefix
+	if dir != "." {
+		prefix = path.Join(prefix, dir)
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("delimiter", "/")
+	query.Set("prefix", prefix)
+	result := []*remoteEntry{}
+	for {
+		req, err := store.request(http.MethodGet, ".", query)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := remoteClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("Unexpected status %s", resp.Status)
+		}
+		var listing s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&listing)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range listing.CommonPrefixes {
+			result = append(result, &remoteEntry{name: path.Base(p.Prefix), dir: true})
+		}
+		for _, object := range listing.Contents {
+			if strings.HasSuffix(object.Key, "/") {
+				continue
+			}
+			result = append(result, &remoteEntry{name: path.Base(object.Key), size: object.Size, modTime: object.LastModified})
+		}
+		if !listing.IsTruncated {
+			break
+		}
+		query.Set("continuation-token", listing.NextContinuationToken)
+	}
+	if len(result) == 0 && dir != "." {
+		return nil, fs.ErrNotExist
+	}
+	return result, nil
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type cacheRepairCommand struct {
+	cli *flag.FlagSet
+}
+
+func newCacheRepairCommand() *cacheRepairCommand {
+	result := &cacheRepairCommand{}
+	result.cli = flag.NewFlagSet(result.Name(), flag.ExitOnError)
+	result.cli.Usage = func() {
+		fmt.Fprintf(result.cli.Output(), "Usage: %s %s CACHE_DIR\n", os.Args[0], result.Name())
+		result.cli.PrintDefaults()
+	}
+	return result
+}
+
+func (cmd *cacheRepairCommand) Name() string {
+	return "cache-repair"
+}
+
+func (cmd *cacheRepairCommand) Desc() string {
+	return "Remove the incomplete entries of the proxy cache and rebuild its index."
+}
+
+func (cmd *cacheRepairCommand) PrintUsage() {
+	cmd.cli.Usage()
+}
+
+// cacheDirs returns the directories of the caches stored in dir: the ones of
+// the routes when it was created with the cache-per-route option, or dir.
+func cacheDirs(dir string) []string {
+	result := []string{}
+	for _, root := range []string{"/frontend/", "/system/", "/cores/"} {
+		routeDir := filepath.Join(dir, strings.Trim(root, "/"))
+		if info, err := os.Stat(routeDir); err == nil && info.IsDir() {
+			result = append(result, routeDir)
+		}
+	}
+	if len(result) == 0 {
+		result = append(result, dir)
+	}
+	return result
+}
+
+func (cmd *cacheRepairCommand) Run(args []string) error {
+	cmd.cli.Parse(args)
+	if cmd.cli.NArg() != 1 {
+		cmd.cli.SetOutput(os.Stderr)
+		cmd.cli.Usage()
+		os.Exit(1)
+	}
+	dir := cmd.cli.Arg(0)
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	for _, cacheDir := range cacheDirs(dir) {
+		cache := &diskCache{dir: cacheDir}
+		report, err := cache.repair()
+		if err != nil {
+			return fmt.Errorf("Cannot repair the cache %s: %w", cacheDir, err)
+		}
+		fmt.Printf("%s: %d entries, %d bytes, %d incomplete files removed\n", cacheDir, report.Entries, report.Size, report.Removed)
+	}
+	return nil
+}
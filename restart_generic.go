@@ -0,0 +1,217 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build !windows
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	listenFdsEnv        string        = "RETROARCH_ASSET_SERVER_LISTEN_FDS"
+	listenerRoleHTTP    string        = "http"
+	listenerRoleTLS     string        = "tls"
+	restartReadyTimeout time.Duration = 30 * time.Second
+)
+
+// inheritedCount is the number of listeners inherited from the parent process.
+var inheritedCount int
+
+// inheritedListeners returns the listeners handed over by the parent process
+// on a graceful restart, and whether each of them accepts TLS connections. They
+// are followed by the pipe used to notify that the new process is ready.
+func inheritedListeners() ([]net.Listener, []bool, error) {
+	value := os.Getenv(listenFdsEnv)
+	if value == "" {
+		return nil, nil, nil
+	}
+	os.Unsetenv(listenFdsEnv)
+	tls := []bool{}
+	if count, err := strconv.Atoi(value); err == nil {
+		// Handed over by a version without the roles of the listeners
+		tls = make([]bool, count)
+	} else {
+		for _, role := range strings.Split(value, ",") {
+			if role != listenerRoleHTTP && role != listenerRoleTLS {
+				return nil, nil, fmt.Errorf("Invalid %s: unknown listener role %s", listenFdsEnv, role)
+			}
+			tls = append(tls, role == listenerRoleTLS)
+		}
+	}
+	result := []net.Listener{}
+	for i := range tls {
+		file := os.NewFile(uintptr(3+i), "listener")
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		result = append(result, listener)
+	}
+	inheritedCount = len(tls)
+	return result, tls, nil
+}
+
+// notifyReady tells the parent process, if any, that the inherited listeners
+// are about to be served.
+func notifyReady() {
+	if inheritedCount == 0 {
+		return
+	}
+	ready := os.NewFile(uintptr(3+inheritedCount), "ready")
+	ready.Write([]byte{0})
+	ready.Close()
+}
+
+// restart starts a new process of the executable with the same arguments,
+// handing over the listeners with their roles, HTTP or TLS, and waits until it
+// is ready.
+func restart(listeners []net.Listener) error {
+	type filer interface {
+		File() (*os.File, error)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	listenersMutex.Lock()
+	listeners = append([]net.Listener{}, listeners...)
+	roles := make([]string, len(listeners))
+	for i := range roles {
+		roles[i] = listenerRoleHTTP
+		if i < len(servedTLS) && servedTLS[i] {
+			roles[i] = listenerRoleTLS
+		}
+	}
+	listenersMutex.Unlock()
+	files := []*os.File{}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, listener := range listeners {
+		l, ok := listener.(filer)
+		if !ok {
+			return fmt.Errorf("Listener %s cannot be handed over", listener.Addr())
+		}
+		file, err := l.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), listenFdsEnv+"="+strings.Join(roles, ","))
+	cmd.ExtraFiles = append(files, readyW)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+		if err != nil {
+			err = fmt.Errorf("New process exited before being ready")
+		}
+	case <-time.After(restartReadyTimeout):
+		err = fmt.Errorf("New process not ready after %s", restartReadyTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// watchRestart restarts the executable on SIGUSR2 without closing the
+// listeners, then gracefully shuts the server down. The returned channel is
+// closed once the shutdown is complete.
+func watchRestart(server *http.Server, listeners []net.Listener, timeout time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	go func() {
+		for range signals {
+			if err := restart(listeners); err != nil {
+				errorf("Restart failed: %v", err)
+				continue
+			}
+			signal.Stop(signals)
+			infof("Restarted, waiting for the current requests to complete")
+			if err := shutdown(server, timeout); err != nil {
+				warnf("Requests interrupted: %v", err)
+			}
+			close(done)
+			return
+		}
+	}()
+	return done
+}
+
+// watchReload reads the listen addresses again on SIGHUP, from the command line
+// args and the configuration files, and binds the listeners again on the
+// addresses which changed.
+func watchReload(listeners []net.Listener, args []string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			opts := &serverOptions{listen: defaultListen}
+			cli := flag.NewFlagSet("serve", flag.ContinueOnError)
+			cli.SetOutput(io.Discard)
+			opts.registerFlags(cli)
+			err := cli.Parse(args)
+			if err == nil {
+				err = reloadListeners(listeners, opts)
+			}
+			if err != nil {
+				errorf("Reloading the listen addresses failed: %v", err)
+			}
+		}
+	}()
+}
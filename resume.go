@@ -0,0 +1,116 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// resumeTokenHeader is the response header holding the resume token of a
+// file download.
+const resumeTokenHeader string = "X-Resume-Token"
+
+// fileETag returns a strong entity tag derived from the modification time and
+// the size of a file.
+func fileETag(info fs.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size())
+}
+
+// encodeResumeToken returns an opaque token embedding the entity tag of a file
+// and the offset of a download.
+func encodeResumeToken(etag string, offset int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d %s", offset, etag)))
+}
+
+// decodeResumeToken returns the entity tag and the offset embedded in a token.
+func decodeResumeToken(token string) (string, int64, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid resume token")
+	}
+	offset, etag, found := strings.Cut(string(data), " ")
+	result, err := strconv.ParseInt(offset, 10, 64)
+	if !found || err != nil || result < 0 {
+		return "", 0, fmt.Errorf("Invalid resume token")
+	}
+	return etag, result, nil
+}
+
+// rangeStart returns the first byte of a single range request, or 0 if the
+// range is absent or not supported.
+func rangeStart(r *http.Request) int64 {
+	spec := strings.TrimPrefix(r.Header.Get("Range"), "bytes=")
+	start, _, found := strings.Cut(spec, "-")
+	if !found || strings.Contains(spec, ",") {
+		return 0
+	}
+	result, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return result
+}
+
+// prepareResume sets the entity tag and the resume token of a file response.
+// When the request provides a resume token, its entity tag must match the one
+// of the file: otherwise the request is answered with a 412 Precondition
+// Failed status rather than with the content of another version of the file.
+// Without a range, the download resumes from the offset of the token. The
+// returned request is the one to serve, or nil if a response was written.
+func (filesystem *fileSystem) prepareResume(w http.ResponseWriter, r *http.Request) *http.Request {
+	file, err := filesystem.Open(path.Clean(r.URL.Path))
+	if err != nil {
+		return r
+	}
+	if _, generated := file.(inMemoryFile); generated {
+		return r
+	}
+	info, err := file.Stat()
+	file.Close()
+	if err != nil || !info.Mode().IsRegular() {
+		return r
+	}
+	etag := fileETag(info)
+	if token := r.URL.Query().Get("resume"); token != "" {
+		tokenETag, offset, err := decodeResumeToken(token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		if tokenETag != etag {
+			http.Error(w, "The file changed since the resume token was issued", http.StatusPreconditionFailed)
+			return nil
+		}
+		if r.Header.Get("Range") == "" && offset > 0 {
+			r = r.Clone(r.Context())
+			r.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set(resumeTokenHeader, encodeResumeToken(etag, rangeStart(r)))
+	return r
+}
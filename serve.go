@@ -21,34 +21,35 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/crc32"
+	"html/template"
 	"io/fs"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
 	"path"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 )
 
 const (
 	retroarchHost string = "http://buildbot.libretro.com/assets/"
 	defaultListen string = ":5164"
+	// indexFooterPrefix starts the checksum footer line of the index files.
+	indexFooterPrefix string = "#entries="
 )
 
-func newReverseProxy(target *url.URL) *httputil.ReverseProxy {
-	proxy := httputil.NewSingleHostReverseProxy(target)
-	director := proxy.Director
-	proxy.Director = func(req *http.Request) {
-		director(req)
-		req.Host = target.Host
-	}
-	return proxy
-}
-
 type inMemoryFile struct {
 	*strings.Reader
 	name string
@@ -87,127 +88,1281 @@ func (f inMemoryFile) Stat() (fs.FileInfo, error) {
 }
 
 type fileSystem struct {
-	Indexed bool
-	SubDirs bool
-	Root    string
-	Source  http.Dir
+	Indexed  bool
+	SubDirs  bool
+	DirIndex bool
+	Root     string
+	Source   http.FileSystem
+	Fallback http.Handler
+	// FallbackOnError serves the files which cannot be read with Fallback,
+	// rather than failing.
+	FallbackOnError bool
+	// JSONListing serves the .index.json file of the directories
+	// requested with a JSON Accept header.
+	JSONListing bool
+	// DirsFilter selects the directories listed in .index-dirs.
+	DirsFilter *nameFilter
+	// IndexChecksum appends a checksum footer to the index files.
+	IndexChecksum bool
+	// IndexMaxAge, when positive, is the duration during which the index
+	// files can be cached, advertised with a Cache-Control header.
+	IndexMaxAge time.Duration
+	// Feed enables the RSS feed of the latest files of each directory.
+	Feed bool
+	// MaxFileSize, when positive, forbids the files larger than it, which are
+	// excluded from the listings.
+	MaxFileSize int64
+	// Template, when set, renders the directory listings.
+	Template *template.Template
+	// Gunzip serves the stored .gz files in place of the missing requested
+	// files.
+	Gunzip bool
+	// Buffers, when set, provides the buffers copying the files.
+	Buffers *copyBufferPool
+	// ResumeTokens sets the entity tag and the resume token of the files.
+	ResumeTokens bool
+	// Listings, when set, keeps the generated listings in memory.
+	Listings *listingCache
+	// ArchiveLevel is the gzip compression level of the tarballs.
+	ArchiveLevel int
+	// TarballLength sends the Content-Length of the tarballs, the gzip ones
+	// being stored without compression.
+	TarballLength bool
+	// IndexDocument, when set, is the name of the file served for the
+	// directories containing it.
+	IndexDocument string
+	// SPAFallback serves the index document of the root in place of the
+	// missing files without an extension.
+	SPAFallback bool
+	// Coalescer, when set, reads only once the files requested concurrently.
+	Coalescer *readCoalescer
+	// UnsafeNames is the handling of the names which would break the index
+	// files: unsafeNamesSkip or unsafeNamesEscape.
+	UnsafeNames string
+	// IndexURLs lists the URL paths of the files in the index files, rather
+	// than their names, prefixed with IndexBaseURL.
+	IndexURLs    bool
+	IndexBaseURL string
+}
+
+// filterFileSize removes the regular files larger than max from files, unless
+// max is not positive.
+func filterFileSize(files []fs.FileInfo, max int64) []fs.FileInfo {
+	if max <= 0 {
+		return files
+	}
+	result := make([]fs.FileInfo, 0, len(files))
+	for _, info := range files {
+		if !info.Mode().IsRegular() || info.Size() <= max {
+			result = append(result, info)
+		}
+	}
+	return result
+}
+
+// sizeLimitedDir hides the files larger than max from a directory listing.
+type sizeLimitedDir struct {
+	http.File
+	max int64
+}
+
+func (d sizeLimitedDir) Readdir(count int) ([]fs.FileInfo, error) {
+	files, err := d.File.Readdir(count)
+	return filterFileSize(files, d.max), err
+}
+
+func (filesystem *fileSystem) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if filesystem.Buffers != nil {
+		w = &copyBufferWriter{ResponseWriter: w, buffers: filesystem.Buffers}
+	}
+	if filesystem.Indexed && filesystem.JSONListing && strings.HasSuffix(r.URL.Path, "/") {
+		w.Header().Add("Vary", "Accept")
+		if prefersJSON(r) {
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path += indexJSONName
+			filesystem.serveIndexJSON(w, r2)
+			return
+		}
+	}
+	if filesystem.Indexed && filesystem.DirIndex && strings.HasSuffix(r.URL.Path, "/") {
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path += ".index"
+		r = r2
+	}
+	if name := r.URL.Path[len(filesystem.Root)-1:]; filesystem.Listings != nil && filesystem.isListing(name) {
+		filesystem.Listings.countRequest(name)
+	}
+	if filesystem.Indexed && filesystem.Feed && path.Base(r.URL.Path) == feedName {
+		filesystem.serveFeed(w, r)
+		return
+	}
+	if filesystem.Indexed && path.Base(r.URL.Path) == indexJSONName {
+		filesystem.serveIndexJSON(w, r)
+		return
+	}
+	if filesystem.Gunzip && !strings.HasSuffix(r.URL.Path, "/") && filesystem.serveGzipped(w, r) {
+		return
+	}
+	if filesystem.SPAFallback && path.Ext(r.URL.Path) == "" && filesystem.serveSPAIndex(w, r) {
+		return
+	}
+	if filesystem.Fallback != nil {
+		err := filesystem.checkReadable(path.Clean(r.URL.Path))
+		if errors.Is(err, fs.ErrNotExist) {
+			filesystem.Fallback.ServeHTTP(w, r)
+			return
+		} else if err != nil && filesystem.FallbackOnError {
+			warnf("Reading %s failed, forwarding it to the upstream server: %v", r.URL.Path, err)
+			filesystem.Fallback.ServeHTTP(w, r)
+			return
+		}
+	}
+	switch base := path.Base(r.URL.Path); base {
+	case ".index", ".index-dirs", ".manifest.json", systemsJSONName:
+		if filesystem.Indexed && filesystem.IndexMaxAge > 0 && base != ".manifest.json" {
+			w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int64(filesystem.IndexMaxAge/time.Second)))
+		}
+		_, s := startSpan(r.Context(), "generate "+base, spanKindInternal)
+		s.setAttribute("url.path", r.URL.Path)
+		defer s.finish()
+	}
+	if filesystem.IndexDocument != "" && strings.HasSuffix(r.URL.Path, "/") && filesystem.serveIndexDocument(w, r, r.URL.Path) {
+		return
+	}
+	if filesystem.Template != nil && strings.HasSuffix(r.URL.Path, "/") && filesystem.serveTemplate(w, r) {
+		return
+	}
+	if filesystem.ResumeTokens && !strings.HasSuffix(r.URL.Path, "/") {
+		if r = filesystem.prepareResume(w, r); r == nil {
+			return
+		}
+	}
+	if filesystem.Coalescer != nil && !strings.HasSuffix(r.URL.Path, "/") && filesystem.serveCoalesced(w, r) {
+		return
+	}
+	http.FileServer(filesystem).ServeHTTP(w, r)
+}
+
+// checkReadable opens a file to check that it exists. With FallbackOnError,
+// the first byte of a regular file is also read, so that a failing storage is
+// detected before the response is sent.
+func (filesystem *fileSystem) checkReadable(name string) error {
+	file, err := filesystem.Open(name)
+	if err != nil || !filesystem.FallbackOnError {
+		if err == nil {
+			file.Close()
+		}
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return err
+	}
+	if _, err := file.Read(make([]byte, 1)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// serveSPAIndex serves the index document of the root if the requested file
+// does not exist, so that a single-page application handles the path. It tells
+// whether the request was served.
+func (filesystem *fileSystem) serveSPAIndex(w http.ResponseWriter, r *http.Request) bool {
+	file, err := filesystem.Open(path.Clean(r.URL.Path))
+	if err == nil {
+		file.Close()
+		return false
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	return filesystem.serveIndexDocument(w, r, filesystem.Root)
+}
+
+// serveIndexDocument serves the index document of a directory and tells
+// whether it exists.
+func (filesystem *fileSystem) serveIndexDocument(w http.ResponseWriter, r *http.Request, dir string) bool {
+	index, err := filesystem.Open(path.Join(dir, filesystem.IndexDocument))
+	if err != nil {
+		return false
+	}
+	defer index.Close()
+	info, err := index.Stat()
+	if err != nil || info.IsDir() {
+		return false
+	}
+	http.ServeContent(w, r, filesystem.IndexDocument, info.ModTime(), index)
+	return true
+}
+
+// readDir returns the entries of a directory of the source.
+func (filesystem *fileSystem) readDir(dir string) ([]fs.FileInfo, error) {
+	d, err := filesystem.Source.Open(path.Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	files, err := d.Readdir(0)
+	if err != nil {
+		return nil, err
+	}
+	return filterFileSize(files, filesystem.MaxFileSize), nil
+}
+
+// listing returns the content of an index file with one entry per line. When
+// IndexChecksum is set, a footer line holding the number of entries and the
+// CRC32 of the previous lines is appended, so that clients can detect
+// truncated transfers.
+func (filesystem *fileSystem) listing(entries []string) string {
+	result := strings.Builder{}
+	for _, entry := range entries {
+		fmt.Fprintln(&result, entry)
+	}
+	if filesystem.IndexChecksum {
+		checksum := crc32.ChecksumIEEE([]byte(result.String()))
+		fmt.Fprintf(&result, "%s%d crc32=%08x\n", indexFooterPrefix, len(entries), checksum)
+	}
+	return result.String()
+}
+
+// isListing tells whether a file of an indexed route is a generated listing.
+func (filesystem *fileSystem) isListing(name string) bool {
+	return (filesystem.SubDirs && name == "/.index-dirs") || path.Base(name) == ".index"
+}
+
+// indexDirs returns the sorted names of the subdirectories listed in the
+// .index-dirs file.
+func (filesystem *fileSystem) indexDirs() ([]string, error) {
+	files, err := filesystem.readDir("/")
+	if err != nil {
+		return nil, err
+	}
+	dirs := []string{}
+	for _, info := range files {
+		if info.IsDir() && filesystem.DirsFilter.match(info.Name()) {
+			dirs = append(dirs, info.Name())
+		}
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// generateListing returns the content of the .index-dirs file or of an .index
+// file.
+func (filesystem *fileSystem) generateListing(name string) (string, error) {
+	if name == "/.index-dirs" {
+		dirs, err := filesystem.indexDirs()
+		if err != nil {
+			return "", err
+		}
+		// The escaped names may sort differently
+		dirs = filesystem.indexEntries("/", dirs)
+		sort.Strings(dirs)
+		return filesystem.listing(dirs), nil
+	}
+	files, err := filesystem.readDir(path.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	names := []string{}
+	for _, info := range files {
+		if info.Mode().IsRegular() {
+			names = append(names, info.Name())
+		}
+	}
+	return filesystem.listing(filesystem.indexEntries(path.Dir(name), names)), nil
 }
 
 func (filesystem *fileSystem) Open(name string) (http.File, error) {
 	name = name[len(filesystem.Root)-1:]
+	if filesystem.UnsafeNames == unsafeNamesEscape {
+		name = filesystem.unescapeName(name)
+	}
 	if filesystem.Indexed {
-		if filesystem.SubDirs {
-			if name == "/.index-dirs" {
-				root, err := filesystem.Source.Open(".")
-				if err != nil {
-					return nil, err
-				}
-				files, err := root.Readdir(0)
-				if err != nil {
-					return nil, err
-				}
-				result := strings.Builder{}
-				for _, info := range files {
-					if info.Mode().Type() == fs.ModeSymlink {
-						info, err = os.Stat(path.Join(string(filesystem.Source), info.Name()))
-						if err != nil {
-							return nil, err
-						}
-					}
-					if info.IsDir() {
-						fmt.Fprintln(&result, info.Name())
-					}
-				}
-				return inMemoryFile{strings.NewReader(result.String()), ".index-dirs"}, nil
-			}
+		if filesystem.SubDirs && name == "/.manifest.json" {
+			return filesystem.coreManifest()
 		}
-		dir, base := path.Split(name)
-		if base == ".index" {
-			d, err := filesystem.Source.Open(dir)
-			if err != nil {
-				return nil, err
+		if filesystem.SubDirs && name == "/"+systemsJSONName {
+			return filesystem.systemsJSON()
+		}
+		if filesystem.isListing(name) {
+			var content string
+			var err error
+			if filesystem.Listings != nil {
+				content, err = filesystem.cachedListing(name)
+			} else {
+				content, err = filesystem.generateListing(name)
 			}
-			files, err := d.Readdir(0)
 			if err != nil {
 				return nil, err
 			}
-			result := strings.Builder{}
-			for _, info := range files {
-				if info.Mode().Type() == fs.ModeSymlink {
-					info, err = os.Stat(path.Join(string(filesystem.Source), dir, info.Name()))
-					if err != nil {
-						return nil, err
-					}
-				}
-				if info.Mode().IsRegular() {
-					fmt.Fprintln(&result, info.Name())
-				}
-			}
-			return inMemoryFile{strings.NewReader(result.String()), ".index"}, nil
+			return inMemoryFile{strings.NewReader(content), path.Base(name)}, nil
 		}
 	}
-	return filesystem.Source.Open(name)
+	file, err := filesystem.Source.Open(name)
+	if err != nil || filesystem.MaxFileSize <= 0 {
+		return file, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		return sizeLimitedDir{file, filesystem.MaxFileSize}, nil
+	}
+	if info.Mode().IsRegular() && info.Size() > filesystem.MaxFileSize {
+		file.Close()
+		return nil, fs.ErrPermission
+	}
+	return file, nil
 }
 
-type serveCommand struct {
-	listen   string
-	frontend string
-	system   string
-	rom      string
-	cli      *flag.FlagSet
+const (
+	listingHTML  string = "html"
+	listingIndex string = "index"
+)
+
+// Handlings of the unsafe names in the index files.
+const (
+	unsafeNamesSkip   string = "skip"
+	unsafeNamesEscape string = "escape"
+)
+
+// isUnsafeName tells whether a file name contains a control character, such as
+// a newline, or a path separator, which would break the index files.
+func isUnsafeName(name string) bool {
+	return strings.IndexFunc(name, func(r rune) bool {
+		return unicode.IsControl(r) || r == '/' || r == '\\'
+	}) >= 0
 }
 
-func newServeCommand() *serveCommand {
-	result := &serveCommand{}
-	result.listen = defaultListen
-	result.cli = flag.NewFlagSet(result.Name(), flag.ExitOnError)
-	result.cli.Func("listen", "Server listening address (default: "+defaultListen+")", func(s string) error {
+// indexEntries returns the entries of an index file of dir, where the unsafe
+// names are skipped or percent-encoded. With IndexURLs, the entries are the
+// percent-encoded URLs of the files.
+func (filesystem *fileSystem) indexEntries(dir string, names []string) []string {
+	prefix := ""
+	if filesystem.IndexURLs {
+		dirURL := &url.URL{Path: path.Join(filesystem.Root, dir)}
+		prefix = filesystem.IndexBaseURL + strings.TrimSuffix(dirURL.EscapedPath(), "/") + "/"
+	}
+	result := names[:0]
+	for _, name := range names {
+		if isUnsafeName(name) && filesystem.UnsafeNames != unsafeNamesEscape {
+			warnf("Skipping %q from the index of %s: unsafe name", name, path.Join(filesystem.Root, dir))
+			continue
+		}
+		if isUnsafeName(name) || filesystem.IndexURLs {
+			name = url.PathEscape(name)
+		}
+		result = append(result, prefix+name)
+	}
+	return result
+}
+
+// Entries of the index files.
+const (
+	indexURLsNames string = "names"
+	indexURLsPaths string = "paths"
+)
+
+// parseIndexURLs returns the base URL prepended to the URL paths listed in the
+// index files for an -index-urls value: paths, or an absolute URL.
+func parseIndexURLs(value string) (string, error) {
+	if value == indexURLsPaths {
+		return "", nil
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("Invalid index URLs %s: expected %s, %s or http[s]://HOST[/PATH]", value, indexURLsNames, indexURLsPaths)
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// unescapeName returns the name of the file whose components with an unsafe
+// name are percent-encoded in name, as listed in the index files with
+// unsafeNamesEscape. The name is returned as is if it exists.
+func (filesystem *fileSystem) unescapeName(name string) string {
+	parts := strings.Split(name, "/")
+	changed := false
+	for i, part := range parts {
+		if !strings.Contains(part, "%") {
+			continue
+		}
+		if unescaped, err := url.PathUnescape(part); err == nil && isUnsafeName(unescaped) {
+			parts[i] = unescaped
+			changed = true
+		}
+	}
+	if !changed {
+		return name
+	}
+	if file, err := filesystem.Source.Open(name); err == nil {
+		file.Close()
+		return name
+	}
+	return strings.Join(parts, "/")
+}
+
+// choiceValue is a flag value restricted to a set of allowed strings.
+type choiceValue struct {
+	value   *string
+	choices []string
+}
+
+func (v choiceValue) String() string {
+	if v.value == nil {
+		return ""
+	}
+	return *v.value
+}
+
+func (v choiceValue) Set(s string) error {
+	for _, choice := range v.choices {
+		if s == choice {
+			*v.value = s
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of %s", strings.Join(v.choices, ", "))
+}
+
+// listValue is a repeatable flag value.
+type listValue []string
+
+func (v *listValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return strings.Join(*v, ",")
+}
+
+func (v *listValue) Set(s string) error {
+	*v = append(*v, s)
+	return nil
+}
+
+// sizeValue is a flag value holding a number of bytes, with an optional binary
+// unit suffix.
+type sizeValue int64
+
+func (v *sizeValue) String() string {
+	if v == nil {
+		return "0"
+	}
+	return strconv.FormatInt(int64(*v), 10)
+}
+
+func (v *sizeValue) Set(s string) error {
+	number, multiplier := s, int64(1)
+	for i, unit := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(strings.ToUpper(s), unit) {
+			number, multiplier = s[:len(s)-1], int64(1)<<(10*(i+1))
+			break
+		}
+	}
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value < 0 {
+		return fmt.Errorf("invalid size %s", s)
+	}
+	*v = sizeValue(value * multiplier)
+	return nil
+}
+
+// rateValue is a flag value holding a number of requests per period, written
+// COUNT/UNIT with a s, m or h unit, or COUNT/DURATION.
+type rateValue struct {
+	count  int
+	period time.Duration
+}
+
+func (v *rateValue) String() string {
+	if v == nil || v.count == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d/%s", v.count, v.period)
+}
+
+func (v *rateValue) Set(s string) error {
+	count, unit, found := strings.Cut(s, "/")
+	value, err := strconv.Atoi(count)
+	if !found || err != nil || value < 0 {
+		return fmt.Errorf("invalid rate %s: expected COUNT/UNIT", s)
+	}
+	period, err := time.ParseDuration(unit)
+	if err != nil {
+		period, err = time.ParseDuration("1" + unit)
+	}
+	if err != nil || period <= 0 {
+		return fmt.Errorf("invalid rate %s: expected COUNT/UNIT", s)
+	}
+	v.count, v.period = value, period
+	return nil
+}
+
+type serverOptions struct {
+	listen           string
+	iface            string
+	interfaceIP      string
+	listenBacklog    int
+	reusePort        bool
+	strictDirs       bool
+	maxConnections   int
+	maxProcs         int
+	listenRetries    int
+	listenRetryDelay time.Duration
+	reloadListen     bool
+	shutdownTimeout  time.Duration
+	drainPeriod      time.Duration
+	drainRetryAfter  time.Duration
+	writeTimeout     time.Duration
+	headerTimeout    time.Duration
+	downloadTimeout  time.Duration
+	idleTimeout      time.Duration
+	advertise        bool
+	checkUpdate      bool
+	configDir        string
+	effectiveConfig  string
+	cacheControl     listValue
+	listenTLS        string
+	tlsCert          string
+	tlsKey           string
+	tlsMinVersion    string
+	tlsCipherSuites  listValue
+	frontend         listValue
+	system           listValue
+	rom              listValue
+	frontendMaxSize  sizeValue
+	systemMaxSize    sizeValue
+	romMaxSize       sizeValue
+	frontendRate     rateValue
+	systemRate       rateValue
+	romRate          rateValue
+	frontendAgents   listValue
+	systemAgents     listValue
+	romAgents        listValue
+	frontendHeaders  listValue
+	systemHeaders    listValue
+	romHeaders       listValue
+	indexDirsInclude listValue
+	indexDirsExclude listValue
+	unsafeNames      string
+	indexURLs        string
+	strictIndex      bool
+	serveDotfiles    bool
+	symlinkCache     int
+	symlinkResolvers int
+	dirListing       string
+	frontendMode     string
+	systemMode       string
+	romMode          string
+	negotiateListing bool
+	indexChecksum    bool
+	indexMaxAge      time.Duration
+	indexRefresh     time.Duration
+	warmListings     bool
+	feed             bool
+	tarballs         bool
+	tarballLength    bool
+	spaFallback      bool
+	upstreamOnError  bool
+	catchallProxy    bool
+	indexDocument    string
+	archiveLevel     int
+	resumeTokens     bool
+	warmup           time.Duration
+	mimeFile         string
+	preload          listValue
+	indexTemplate    string
+	adminToken       string
+	cacheDir         string
+	cacheTTL         time.Duration
+	cacheKeyQuery    bool
+	cacheKeyHeaders  listValue
+	serveStale       bool
+	headCacheTTL     time.Duration
+	cacheMaxSize     sizeValue
+	cachePerRoute    bool
+	minFreeSpace     sizeValue
+	frontendCacheMax sizeValue
+	systemCacheMax   sizeValue
+	romCacheMax      sizeValue
+	proxyMaxDuration time.Duration
+	remoteTimeout    time.Duration
+	proxyMaxConns    int
+	copyBufferSize   sizeValue
+	coalesceReads    sizeValue
+	proxyGzip        bool
+	upstreamRewrites listValue
+	errorPages       listValue
+	blockUserAgents  listValue
+	allowedMethods   listValue
+	accessLog        string
+	logErrorsOnly    bool
+	logExcludePaths  listValue
+	geoIPDB          string
+	dumpRequests     bool
+	versionHeader    bool
+	logLevel         string
+	slowRequest      time.Duration
+	otelEndpoint     string
+	otelSampleRatio  float64
+}
+
+func (opts *serverOptions) registerFlags(cli *flag.FlagSet) {
+	cli.Func("listen", "Server listening address (default: "+defaultListen+")", func(s string) error {
 		endPoint, err := net.ResolveTCPAddr("tcp", s)
 		if err == nil {
-			result.listen = endPoint.String()
+			opts.listen = endPoint.String()
 		}
 		return err
 	})
-	result.cli.StringVar(&result.frontend, "frontend", "", "path of the directory where frontend is stored (optional)")
-	result.cli.StringVar(&result.system, "system", "", "path of the directory where systems are stored (optional)")
-	result.cli.StringVar(&result.rom, "rom", "", "path of the directory where ROMs are stored (optional)")
+	cli.StringVar(&opts.effectiveConfig, "write-effective-config", "", "JSON file where the values of all the options, including the default ones, are written at startup, the secrets being redacted (optional)")
+	cli.Var(configDirValue{cli, &opts.configDir}, "config-dir", "directory of *.conf files of options, applied in the order of their names where this option appears")
+	cli.StringVar(&opts.iface, "interface", "", "name of the network interface to listen to, on the port of the listen option (optional)")
+	opts.interfaceIP = interfaceIPAll
+	cli.Var(choiceValue{&opts.interfaceIP, []string{interfaceIPAll, interfaceIPv4, interfaceIPv6}}, "interface-ip", "addresses of the interface to listen to: "+interfaceIPAll+", "+interfaceIPv4+" or "+interfaceIPv6)
+	cli.IntVar(&opts.listenBacklog, "listen-backlog", 0, "size of the queue of the connections waiting to be accepted (0 for the system default)")
+	cli.BoolVar(&opts.reusePort, "reuseport", false, "let several server processes listen to the same port, the system balancing the connections between them")
+	cli.IntVar(&opts.maxConnections, "max-connections", 0, "maximum number of concurrent connections, the others wait in the listen backlog (0 for no limit)")
+	cli.IntVar(&opts.maxProcs, "max-procs", 0, "maximum number of CPUs executing the server simultaneously (0 for all the CPUs)")
+	cli.IntVar(&opts.listenRetries, "listen-retries", 0, "number of times a failed listener is bound again before the server stops (0 to stop on the first failure)")
+	cli.DurationVar(&opts.listenRetryDelay, "listen-retry-delay", time.Second, "delay before binding a failed listener again, doubled on each retry")
+	cli.BoolVar(&opts.reloadListen, "reload-listen", false, "on SIGHUP, read the listen addresses again from the command line and the configuration files, and replace the listeners whose address changed")
+	cli.DurationVar(&opts.shutdownTimeout, "shutdown-timeout", 10*time.Second, "maximum duration to wait for the current requests when the server stops (0 for no limit)")
+	cli.DurationVar(&opts.drainPeriod, "drain-period", 0, "maximum duration during which the new requests are rejected with a 503 status when the server stops, before shutdown-timeout applies (0 to stop listening immediately)")
+	cli.DurationVar(&opts.drainRetryAfter, "drain-retry-after", 30*time.Second, "delay suggested to the clients in the Retry-After header of the requests rejected during drain-period (0 for no header)")
+	cli.DurationVar(&opts.headerTimeout, "read-header-timeout", 0, "maximum duration to read the headers of a request, after which its connection is closed (0 for no limit)")
+	cli.DurationVar(&opts.writeTimeout, "write-timeout", 0, "maximum duration to write a response (0 for no limit)")
+	cli.DurationVar(&opts.downloadTimeout, "download-write-timeout", 0, "maximum duration to write the response of a file download over HTTP/1, instead of write-timeout (0 for write-timeout)")
+	cli.DurationVar(&opts.idleTimeout, "idle-timeout", 0, "maximum duration to wait for the next request on a keep-alive connection (0 for no limit)")
+	cli.BoolVar(&opts.advertise, "advertise", false, "advertise the server on the local network with mDNS as "+mdnsService)
+	cli.StringVar(&opts.listenTLS, "listen-tls", "", "HTTPS listening address, the listen address serving plain HTTP then (optional, requires tls-cert and tls-key)")
+	cli.StringVar(&opts.tlsCert, "tls-cert", "", "path of the PEM certificate file, serving only HTTPS when provided with tls-key unless listen-tls is set (optional)")
+	cli.StringVar(&opts.tlsKey, "tls-key", "", "path of the PEM private key file of the certificate (optional)")
+	opts.tlsMinVersion = "1.2"
+	cli.Var(choiceValue{&opts.tlsMinVersion, []string{"1.2", "1.3"}}, "tls-min-version", "minimum TLS version accepted by the HTTPS listeners: 1.2 or 1.3")
+	cli.Var(&opts.tlsCipherSuites, "tls-cipher-suite", "name of a cipher suite accepted by the HTTPS listeners with TLS 1.2, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (repeatable, the secure Go defaults when omitted)")
+	cli.Var(&opts.frontend, "frontend", "path or URL of the directory where frontend is stored, or "+upstreamLocation+" (optional, repeatable by priority order)")
+	cli.Var(&opts.system, "system", "path or URL of the directory where systems are stored, or "+upstreamLocation+" (optional, repeatable by priority order)")
+	cli.Var(&opts.rom, "rom", "path or URL of the directory where ROMs are stored, or "+upstreamLocation+" (optional, repeatable by priority order)")
+	modes := []string{routeAuto, routeLocal, routeProxy, routeFallback, routeDisabled}
+	modesUsage := "mode of the %s route: " + strings.Join(modes, ", ") + " (" + routeAuto + " proxies the route without location)"
+	opts.frontendMode = routeAuto
+	cli.Var(choiceValue{&opts.frontendMode, modes}, "frontend-mode", fmt.Sprintf(modesUsage, "frontend"))
+	opts.systemMode = routeAuto
+	cli.Var(choiceValue{&opts.systemMode, modes}, "system-mode", fmt.Sprintf(modesUsage, "system"))
+	opts.romMode = routeAuto
+	cli.Var(choiceValue{&opts.romMode, modes}, "rom-mode", fmt.Sprintf(modesUsage, "ROM"))
+	cli.BoolVar(&opts.strictDirs, "strict-dirs", false, "fail at startup when the local locations of different routes are identical or nested, instead of only warning")
+	cli.BoolVar(&opts.upstreamOnError, "upstream-on-error", false, "forward the requests of the local files which cannot be read to the upstream server, on the routes whose last location is "+upstreamLocation)
+	cli.BoolVar(&opts.catchallProxy, "catchall-proxy", false, "forward the requests of the paths outside the routes to the upstream server instead of answering with a 404 status")
+	cli.BoolVar(&opts.spaFallback, "spa-fallback", false, "serve the index document of the frontend route in place of the missing files without an extension, for single-page applications")
+	cli.StringVar(&opts.indexDocument, "index-document", "index.html", "name of the file served for the directories of the frontend route containing it")
+	cli.Var(&opts.frontendMaxSize, "frontend-max-file-size", "maximum size of the files served by the frontend route, with an optional K, M, G or T suffix (0 for no limit)")
+	cli.Var(&opts.systemMaxSize, "system-max-file-size", "maximum size of the files served by the system route, with an optional K, M, G or T suffix (0 for no limit)")
+	cli.Var(&opts.romMaxSize, "rom-max-file-size", "maximum size of the files served by the ROM route, with an optional K, M, G or T suffix (0 for no limit)")
+	cli.Var(&opts.frontendRate, "frontend-rate-limit", "maximum number of requests of a client address to the frontend route per period, such as 100/m, the others being rejected with a 429 status (optional)")
+	cli.Var(&opts.systemRate, "system-rate-limit", "maximum number of requests of a client address to the system route per period, such as 100/m, the others being rejected with a 429 status (optional)")
+	cli.Var(&opts.romRate, "rom-rate-limit", "maximum number of requests of a client address to the ROM route per period, such as 100/m, the others being rejected with a 429 status (optional)")
+	cli.Var(&opts.frontendAgents, "frontend-user-agent", "REGEXP=LOCATION serving the frontend route from LOCATION to the clients whose User-Agent header matches REGEXP, in place of -frontend (repeatable, the locations of the same expression being chained)")
+	cli.Var(&opts.systemAgents, "system-user-agent", "REGEXP=LOCATION serving the system route from LOCATION to the clients whose User-Agent header matches REGEXP, in place of -system (repeatable, the locations of the same expression being chained)")
+	cli.Var(&opts.romAgents, "rom-user-agent", "REGEXP=LOCATION serving the ROM route from LOCATION to the clients whose User-Agent header matches REGEXP, in place of -rom (repeatable, the locations of the same expression being chained)")
+	cli.Var(&opts.indexDirsInclude, "index-dirs-include", "pattern of the directory names listed in .index-dirs (repeatable, all directories when omitted)")
+	cli.Var(&opts.indexDirsExclude, "index-dirs-exclude", "pattern of the directory names excluded from .index-dirs (repeatable)")
+	opts.unsafeNames = unsafeNamesSkip
+	cli.Var(choiceValue{&opts.unsafeNames, []string{unsafeNamesSkip, unsafeNamesEscape}}, "index-unsafe-names", "handling of the file names with a control character or a path separator in the index files: "+unsafeNamesSkip+" them or "+unsafeNamesEscape+" them with percent-encoding")
+	cli.StringVar(&opts.indexURLs, "index-urls", indexURLsNames, "entries of the index files: file "+indexURLsNames+", URL "+indexURLsPaths+", or the base URL of the server, such as https://assets.example.com, prepended to the URL paths")
+	cli.IntVar(&opts.symlinkCache, "symlink-cache", 0, "maximum number of resolved symbolic links of the local directories kept in memory for the next listings (0 to disable)")
+	cli.IntVar(&opts.symlinkResolvers, "symlink-cache-concurrency", 4, "maximum number of symbolic links of a listing resolved at the same time when they are not cached")
+	cli.BoolVar(&opts.serveDotfiles, "serve-dotfiles", false, "serve and list the local files and directories whose name starts with a dot, such as .git or .DS_Store, other than the index files")
+	cli.BoolVar(&opts.strictIndex, "strict-index", false, "fail the listings of the local directories with an unreadable entry, such as a dangling symbolic link, which is skipped with a warning otherwise")
+	opts.dirListing = listingHTML
+	cli.Var(choiceValue{&opts.dirListing, []string{listingHTML, listingIndex}}, "dir-listing", "response to a bare directory request on indexed routes: "+listingHTML+" listing or "+listingIndex+" file")
+	cli.BoolVar(&opts.negotiateListing, "negotiate-dir-listing", false, "serve the JSON index of the directories of indexed routes requested with an Accept: application/json header")
+	cli.BoolVar(&opts.indexChecksum, "index-checksum", false, "append a footer line with the entry count and the CRC32 of the listing to the index files")
+	cli.Var(&opts.cacheControl, "cache-control", "Cache-Control header of the files with an extension, as .EXT=DIRECTIVES, such as .zip=max-age=31536000,immutable (repeatable)")
+	cli.DurationVar(&opts.indexMaxAge, "index-max-age", 0, "duration during which the index files can be cached by clients and proxies, advertised with a Cache-Control header (0 to disable)")
+	cli.DurationVar(&opts.indexRefresh, "index-refresh", 0, "keep the index files in memory and generate again the ones whose directory changed at this interval (0 to generate them on each request)")
+	cli.BoolVar(&opts.warmListings, "warm-listings", false, "generate in the background the listings kept in memory by index-refresh when the server starts and after they are flushed")
+	cli.BoolVar(&opts.feed, "feed", false, "serve an RSS feed of the latest files of each directory of indexed routes as "+feedName)
+	cli.StringVar(&opts.indexTemplate, "index-template", "", "path of the html/template file rendering the directory listings (optional)")
+	cli.BoolVar(&opts.tarballs, "tarballs", false, "serve a tar.gz archive of each route with local directories, such as /frontend.tar.gz")
+	cli.BoolVar(&opts.tarballLength, "tarball-content-length", false, "list the files of the tarballs before sending them to set their Content-Length, the tarballs being then stored without compression")
+	cli.IntVar(&opts.archiveLevel, "archive-compression-level", 6, "gzip compression level of the tarballs, from 0 (no compression) to 9 (best compression)")
+	cli.BoolVar(&opts.resumeTokens, "resume-tokens", false, "send an entity tag and a resume token with the files, allowing to resume a download only if the file did not change")
+	cli.Var(&opts.preload, "preload", "URL path pattern of the files kept in memory, such as /frontend/assets/*.png (repeatable)")
+	cli.DurationVar(&opts.warmup, "warmup", 0, "maximum duration of the directory scan done before accepting connections (0 to disable)")
+	cli.StringVar(&opts.adminToken, "admin-token", "", "token required to access the /admin/ endpoints, which are disabled when empty")
+	cli.StringVar(&opts.cacheDir, "cache-dir", "", "path of the directory where proxied assets are cached, created if missing (optional)")
+	cli.DurationVar(&opts.cacheTTL, "cache-ttl", 24*time.Hour, "duration during which a cached asset is served without contacting the upstream server")
+	cli.BoolVar(&opts.cacheKeyQuery, "cache-key-query", false, "include the query string in the key of the cached assets, which only depends on their path otherwise")
+	cli.Var(&opts.cacheKeyHeaders, "cache-key-header", "name of a request header whose value is included in the key of the cached assets (repeatable)")
+	cli.DurationVar(&opts.headCacheTTL, "head-cache-ttl", 0, "duration during which the responses of the upstream server to the HEAD requests are kept in memory and served again (0 to disable)")
+	cli.BoolVar(&opts.serveStale, "serve-stale-on-error", false, "serve the cached assets older than cache-ttl when the upstream server fails or cannot be reached")
+	cli.Var(&opts.cacheMaxSize, "cache-max-size", "maximum size of the cached assets, with an optional K, M, G or T suffix, the least recently used ones being evicted (0 for no limit)")
+	cli.BoolVar(&opts.cachePerRoute, "cache-per-route", false, "cache the assets of each route in a separate subdirectory of the cache directory, with its own size limit")
+	cli.Var(&opts.frontendCacheMax, "frontend-cache-max-size", "maximum size of the cached assets of the frontend route with cache-per-route, with an optional K, M, G or T suffix (cache-max-size when omitted)")
+	cli.Var(&opts.systemCacheMax, "system-cache-max-size", "maximum size of the cached assets of the system route with cache-per-route, with an optional K, M, G or T suffix (cache-max-size when omitted)")
+	cli.Var(&opts.romCacheMax, "rom-cache-max-size", "maximum size of the cached assets of the ROM route with cache-per-route, with an optional K, M, G or T suffix (cache-max-size when omitted)")
+	cli.Var(&opts.minFreeSpace, "min-free-space", "free space of the cache directory, with an optional K, M, G or T suffix, below which /healthz reports the server as unhealthy (0 to disable)")
+	cli.DurationVar(&opts.remoteTimeout, "remote-timeout", 30*time.Second, "maximum duration to connect to a remote location and to wait for its response headers, the body transfer being unlimited (0 for no limit)")
+	cli.DurationVar(&opts.proxyMaxDuration, "proxy-max-duration", 0, "maximum duration of a proxied request, including the body transfer (0 for no limit)")
+	cli.IntVar(&opts.proxyMaxConns, "proxy-max-conns", 0, "maximum number of concurrent connections to the upstream server, the other requests being queued (0 for no limit)")
+	cli.Var(&opts.copyBufferSize, "copy-buffer-size", "size of the buffers copying the served files and the proxied responses, with an optional K, M, G or T suffix (0 for the default)")
+	cli.Var(&opts.coalesceReads, "coalesce-reads", "maximum size of the files read only once for the concurrent requests, with an optional K, M, G or T suffix (0 to disable)")
+	cli.BoolVar(&opts.proxyGzip, "proxy-gzip", false, "gzip the text assets of the upstream server when the client accepts it")
+	cli.Var(&opts.frontendHeaders, "frontend-upstream-header", "NAME: VALUE header added to the requests of the frontend route forwarded to the upstream server, VALUE being read from the file PATH when written @PATH (repeatable)")
+	cli.Var(&opts.systemHeaders, "system-upstream-header", "NAME: VALUE header added to the requests of the system route forwarded to the upstream server, VALUE being read from the file PATH when written @PATH (repeatable)")
+	cli.Var(&opts.romHeaders, "rom-upstream-header", "NAME: VALUE header added to the requests of the ROM route forwarded to the upstream server, VALUE being read from the file PATH when written @PATH (repeatable)")
+	cli.Var(&opts.upstreamRewrites, "upstream-rewrite", "REGEXP=/PATH rule replacing the proxied request paths matching REGEXP with a path of the upstream server, with $1 for the first submatch (repeatable, the first matching rule applies)")
+	cli.Var(&opts.errorPages, "error-page", "CODE=PATH of a page served for the responses with this status code (repeatable)")
+	cli.Var(&opts.blockUserAgents, "block-user-agents", "regular expression of the User-Agent headers whose requests are rejected with a 403 status (repeatable)")
+	cli.Var(&opts.allowedMethods, "allow-method", "HTTP method accepted by the server, the requests with another method being rejected with a 405 status (repeatable, GET and HEAD when omitted)")
+	cli.StringVar(&opts.accessLog, "access-log", "", "path of the file where the requests are logged, - for the standard output (optional)")
+	cli.BoolVar(&opts.logErrorsOnly, "log-errors-only", false, "log only the requests with a status code of 400 or more in the access log")
+	cli.Var(&opts.logExcludePaths, "log-exclude-path", "prefix of the URL paths of the requests which are not written to the access log (repeatable)")
+	cli.StringVar(&opts.geoIPDB, "geoip-db", "", "path of a MaxMind DB file, such as GeoLite2-Country.mmdb, used to append the country code of the clients to the access log (optional)")
+	cli.DurationVar(&opts.slowRequest, "slow-request-threshold", 0, "duration above which a request is logged as slow (0 to disable)")
+	opts.logLevel = logLevelNames[levelInfo]
+	cli.BoolVar(&opts.checkUpdate, "check-update", false, "log whether a newer version is released when the server starts")
+	cli.Var(choiceValue{&opts.logLevel, logLevelNames}, "log-level", "minimum level of the logged messages: "+strings.Join(logLevelNames, ", "))
+	cli.BoolVar(&opts.dumpRequests, "dump-requests", false, "log the request line and the headers of every request, for debugging purposes (verbose)")
+	cli.BoolVar(&opts.versionHeader, "version-header", false, "add the version of the server to the responses in an X-RAAS-Version header")
+	cli.StringVar(&opts.otelEndpoint, "otel-endpoint", "", "URL of the OpenTelemetry collector receiving the traces over OTLP/HTTP, tracing is disabled when empty")
+	cli.Float64Var(&opts.otelSampleRatio, "otel-sample-ratio", 1, "ratio of the traces exported to the OpenTelemetry collector")
+	cli.StringVar(&opts.mimeFile, "mime-file", "", "path of a file mapping extensions to content types, one EXT=TYPE per line (optional)")
+}
+
+type serveCommand struct {
+	options serverOptions
+	cli     *flag.FlagSet
+}
+
+func newServeCommand() *serveCommand {
+	result := &serveCommand{}
+	result.options.listen = defaultListen
+	result.cli = flag.NewFlagSet(result.Name(), flag.ExitOnError)
+	result.options.registerFlags(result.cli)
 	return result
 }
 
-func newServer(listen, frontend, system, rom string) *http.Server {
+// newTLSConfig returns the TLS configuration of the HTTPS listeners, without
+// certificate. The insecure or unknown cipher suites are rejected.
+func newTLSConfig(opts *serverOptions) (*tls.Config, error) {
+	result := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.tlsMinVersion == "1.3" {
+		result.MinVersion = tls.VersionTLS13
+	}
+	if len(opts.tlsCipherSuites) == 0 {
+		return result, nil
+	}
+	if result.MinVersion == tls.VersionTLS13 {
+		return nil, fmt.Errorf("The tls-cipher-suite option does not apply to TLS 1.3, whose cipher suites are not configurable")
+	}
+	secure := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite.ID
+	}
+	insecure := map[string]bool{}
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+	for _, name := range opts.tlsCipherSuites {
+		id, ok := secure[name]
+		if !ok {
+			if insecure[name] {
+				return nil, fmt.Errorf("Insecure cipher suite %s", name)
+			}
+			return nil, fmt.Errorf("Unknown cipher suite %s", name)
+		}
+		if !strings.HasPrefix(name, "TLS_ECDHE_") {
+			// Only the suites with forward secrecy are accepted
+			return nil, fmt.Errorf("Insecure cipher suite %s: no forward secrecy", name)
+		}
+		result.CipherSuites = append(result.CipherSuites, id)
+	}
+	for _, id := range result.CipherSuites {
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return result, nil
+		}
+	}
+	return nil, fmt.Errorf("The cipher suites must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, required by HTTP/2")
+}
+
+// validateOptions returns the errors of the options which are invalid on their
+// own or combined with the other ones, without loading the files they name.
+func validateOptions(opts *serverOptions) []error {
+	problems := []error{}
+	if opts.maxProcs < 0 {
+		problems = append(problems, fmt.Errorf("Invalid maximum number of CPUs %d", opts.maxProcs))
+	}
+	if opts.strictDirs {
+		for _, overlap := range overlappingLocations(opts) {
+			problems = append(problems, fmt.Errorf("%s", overlap))
+		}
+	}
+	if opts.indexDocument == "" || strings.ContainsAny(opts.indexDocument, "/\\") {
+		problems = append(problems, fmt.Errorf("Invalid index document %s: expected a file name", opts.indexDocument))
+	}
+	if opts.archiveLevel < gzip.NoCompression || opts.archiveLevel > gzip.BestCompression {
+		problems = append(problems, fmt.Errorf("Invalid archive compression level %d: expected 0 to 9", opts.archiveLevel))
+	}
+	routes := []struct {
+		option string
+		mode   string
+		agents []string
+	}{
+		{"frontend", opts.frontendMode, opts.frontendAgents},
+		{"system", opts.systemMode, opts.systemAgents},
+		{"rom", opts.romMode, opts.romAgents},
+	}
+	for _, route := range routes {
+		if (route.mode == routeDisabled || route.mode == routeProxy) && len(route.agents) > 0 {
+			problems = append(problems, fmt.Errorf("The %s-user-agent option does not apply to the %s mode", route.option, route.mode))
+		}
+		if _, err := parseUserAgentRules(route.agents); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if _, err := newNameFilter(opts.indexDirsInclude, opts.indexDirsExclude); err != nil {
+		problems = append(problems, err)
+	}
+	if opts.indexURLs != indexURLsNames {
+		if _, err := parseIndexURLs(opts.indexURLs); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if _, err := parseRewriteRules(opts.upstreamRewrites); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := parseCacheControlRules(opts.cacheControl); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := parseUserAgentPatterns(opts.blockUserAgents); err != nil {
+		problems = append(problems, err)
+	}
+	for _, spec := range opts.errorPages {
+		if _, _, err := parseErrorPage(spec); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if opts.otelEndpoint != "" {
+		if _, err := parseOTelEndpoint(opts.otelEndpoint); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if opts.tlsCert != "" {
+		if _, err := newTLSConfig(opts); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if opts.warmListings && opts.indexRefresh <= 0 {
+		problems = append(problems, fmt.Errorf("The warm-listings option requires the index-refresh option"))
+	}
+	if opts.minFreeSpace > 0 && opts.cacheDir == "" {
+		problems = append(problems, fmt.Errorf("The min-free-space option requires the cache-dir option"))
+	}
+	if opts.geoIPDB != "" && opts.accessLog == "" {
+		problems = append(problems, fmt.Errorf("The geoip-db option requires the access-log option"))
+	}
+	if (opts.tlsCert == "") != (opts.tlsKey == "") {
+		problems = append(problems, fmt.Errorf("Both tls-cert and tls-key options must be provided"))
+	}
+	if opts.listenTLS != "" {
+		if opts.tlsCert == "" && opts.tlsKey == "" {
+			problems = append(problems, fmt.Errorf("The listen-tls option requires the tls-cert and tls-key options"))
+		}
+		_, tlsPort, err := net.SplitHostPort(opts.listenTLS)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("Invalid TLS listening address %s: %w", opts.listenTLS, err))
+		} else if _, port, err := net.SplitHostPort(opts.listen); err == nil && port == tlsPort && port != "0" {
+			problems = append(problems, fmt.Errorf("The listen and listen-tls options must use different ports"))
+		}
+	}
+	return problems
+}
+
+func newServer(opts *serverOptions) (*http.Server, error) {
+	setLogLevel(opts.logLevel)
+	if problems := validateOptions(opts); len(problems) > 0 {
+		return nil, problems[0]
+	}
+	if opts.maxProcs > 0 {
+		runtime.GOMAXPROCS(opts.maxProcs)
+	}
+	if opts.mimeFile != "" {
+		if err := loadMimeFile(opts.mimeFile); err != nil {
+			return nil, err
+		}
+	}
+	if !opts.strictDirs {
+		for _, overlap := range overlappingLocations(opts) {
+			warnf("%s, which serves its files on both routes", overlap)
+		}
+	}
+	caches, err := newCacheSet(opts)
+	if err != nil {
+		return nil, err
+	}
+	dirsFilter, err := newNameFilter(opts.indexDirsInclude, opts.indexDirsExclude)
+	if err != nil {
+		return nil, err
+	}
+	var indexTemplate *template.Template
+	if opts.indexTemplate != "" {
+		indexTemplate, err = loadIndexTemplate(opts.indexTemplate)
+		if err != nil {
+			return nil, err
+		}
+	}
+	indexURLs, indexBaseURL := opts.indexURLs != indexURLsNames, ""
+	if indexURLs {
+		indexBaseURL, err = parseIndexURLs(opts.indexURLs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var buffers *copyBufferPool
+	if opts.copyBufferSize > 0 {
+		buffers = newCopyBufferPool(int(opts.copyBufferSize))
+	}
+	remoteClient = newRemoteClient(opts.remoteTimeout)
+	var links *symlinkCache
+	if opts.symlinkCache > 0 {
+		links = newSymlinkCache(opts.symlinkCache, opts.symlinkResolvers)
+	}
+	proxyURL, err := parseUpstreamURL(retroarchHost)
+	if err != nil {
+		return nil, err
+	}
 	handler := http.NewServeMux()
-	proxyURL, _ := url.Parse(retroarchHost)
-	if frontend == "" {
-		handler.Handle("/frontend/", newReverseProxy(proxyURL))
-	} else {
-		handler.Handle("/frontend/", http.FileServer(&fileSystem{
-			Indexed: false,
-			SubDirs: false,
-			Root:    "/frontend/",
-			Source:  http.Dir(frontend),
-		}))
-	}
-	if system == "" {
-		handler.Handle("/system/", newReverseProxy(proxyURL))
-	} else {
-		handler.Handle("/system/", http.FileServer(&fileSystem{
-			Indexed: true,
-			SubDirs: false,
-			Root:    "/system/",
-			Source:  http.Dir(system),
-		}))
-	}
-	if rom == "" {
-		handler.Handle("/cores/", newReverseProxy(proxyURL))
-	} else {
-		handler.Handle("/cores/", http.FileServer(&fileSystem{
-			Indexed: true,
-			SubDirs: true,
-			Root:    "/cores/",
-			Source:  http.Dir(rom),
-		}))
-	}
-	return &http.Server{Addr: listen, Handler: handler}
+	rewriteRules, err := parseRewriteRules(opts.upstreamRewrites)
+	if err != nil {
+		return nil, err
+	}
+	upstreamHeaders := []upstreamHeader{}
+	for _, route := range []struct {
+		root   string
+		values []string
+	}{{"/frontend/", opts.frontendHeaders}, {"/system/", opts.systemHeaders}, {"/cores/", opts.romHeaders}} {
+		headers, err := parseUpstreamHeaders(route.root, route.values)
+		if err != nil {
+			return nil, err
+		}
+		upstreamHeaders = append(upstreamHeaders, headers...)
+	}
+	proxy, heads := newReverseProxy(proxyURL, opts, caches, buffers, rewriteRules, upstreamHeaders)
+	dirIndex := opts.dirListing == listingIndex
+	flusher := &cacheFlusher{caches: caches, heads: heads, warm: opts.warmListings}
+	routes := []struct {
+		root        string
+		locations   []string
+		indexed     bool
+		subDirs     bool
+		maxFileSize sizeValue
+		mode        string
+		rateLimit   rateValue
+		userAgents  []string
+	}{
+		{"/frontend/", opts.frontend, false, false, opts.frontendMaxSize, opts.frontendMode, opts.frontendRate, opts.frontendAgents},
+		{"/system/", opts.system, true, false, opts.systemMaxSize, opts.systemMode, opts.systemRate, opts.systemAgents},
+		{"/cores/", opts.rom, true, true, opts.romMaxSize, opts.romMode, opts.romRate, opts.romAgents},
+	}
+	download := func(next http.Handler) http.Handler {
+		if opts.downloadTimeout > 0 {
+			return extendWriteDeadline(opts.downloadTimeout, next)
+		}
+		return next
+	}
+	for _, route := range routes {
+		var limiter *rateLimiter
+		if route.rateLimit.count > 0 {
+			limiter = newRateLimiter(route.rateLimit)
+		}
+		// routed applies the limit of the route, shared with its tarballs
+		routed := func(next http.Handler) http.Handler {
+			if limiter != nil {
+				return limiter.middleware(download(next))
+			}
+			return download(next)
+		}
+		switch route.mode {
+		case routeDisabled:
+			handler.Handle(route.root, http.NotFoundHandler())
+			continue
+		case routeProxy:
+			handler.Handle(route.root, routed(proxy))
+			continue
+		}
+		// serveLocations returns the handler of the route serving locations,
+		// and the handler of its tarballs, nil without local location
+		serveLocations := func(locations []string) (http.Handler, http.Handler, error) {
+			locations, err := routeLocations(locations, route.mode)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Route %s: %w", route.root, err)
+			}
+			source, upstream, err := newChainSource(locations, opts.strictIndex, links)
+			if err != nil {
+				return nil, nil, err
+			}
+			if source == nil {
+				return proxy, nil, nil
+			}
+			if !opts.serveDotfiles {
+				source = dotfileHider{source}
+			}
+			if len(opts.preload) > 0 {
+				preloaded, err := newPreloadSource(source, route.root, opts.preload)
+				if err != nil {
+					return nil, nil, err
+				}
+				if len(preloaded.files) > 0 {
+					infof("Preloaded %d files of %s", len(preloaded.files), route.root)
+					source = preloaded
+				}
+			}
+			filesystem := &fileSystem{
+				Indexed:       route.indexed,
+				SubDirs:       route.subDirs,
+				DirIndex:      route.indexed && dirIndex,
+				JSONListing:   opts.negotiateListing,
+				Root:          route.root,
+				Source:        source,
+				DirsFilter:    dirsFilter,
+				IndexChecksum: opts.indexChecksum,
+				IndexMaxAge:   opts.indexMaxAge,
+				Feed:          opts.feed,
+				MaxFileSize:   int64(route.maxFileSize),
+				Template:      indexTemplate,
+				Gunzip:        route.subDirs,
+				Buffers:       buffers,
+				ResumeTokens:  opts.resumeTokens,
+				ArchiveLevel:  opts.archiveLevel,
+				TarballLength: opts.tarballLength,
+				SPAFallback:   !route.indexed && opts.spaFallback,
+				UnsafeNames:   opts.unsafeNames,
+				IndexURLs:     indexURLs,
+				IndexBaseURL:  indexBaseURL,
+			}
+			if upstream {
+				filesystem.Fallback = proxy
+				filesystem.FallbackOnError = opts.upstreamOnError
+			}
+			if !route.indexed {
+				filesystem.IndexDocument = opts.indexDocument
+			}
+			if opts.coalesceReads > 0 {
+				filesystem.Coalescer = newReadCoalescer(int64(opts.coalesceReads))
+			}
+			if route.indexed && opts.indexRefresh > 0 {
+				filesystem.Listings = newListingCache()
+				go filesystem.refreshListings(opts.indexRefresh)
+				if opts.warmListings {
+					go func() {
+						start := time.Now()
+						count := filesystem.warmListings()
+						infof("Generated %d listings of %s in %s", count, filesystem.Root, time.Since(start).Round(time.Millisecond))
+					}()
+				}
+				flusher.filesystems = append(flusher.filesystems, filesystem)
+			}
+			return filesystem, http.HandlerFunc(filesystem.serveTarball), nil
+		}
+		served, tarball, err := serveLocations(route.locations)
+		if err != nil {
+			return nil, err
+		}
+		if len(route.userAgents) > 0 {
+			rules, err := parseUserAgentRules(route.userAgents)
+			if err != nil {
+				return nil, err
+			}
+			tarballRules := make([]userAgentRule, len(rules))
+			for i := range rules {
+				rules[i].handler, tarballRules[i].handler, err = serveLocations(rules[i].locations)
+				if err != nil {
+					return nil, err
+				}
+				tarballRules[i].pattern = rules[i].pattern
+				if tarballRules[i].handler == nil {
+					tarballRules[i].handler = http.NotFoundHandler()
+				}
+			}
+			served = routeUserAgents(rules, served)
+			if tarball != nil {
+				tarball = routeUserAgents(tarballRules, tarball)
+			}
+		}
+		handler.Handle(route.root, routed(served))
+		if opts.tarballs && tarball != nil {
+			handler.Handle(tarballPath(route.root), routed(tarball))
+		}
+	}
+	if opts.catchallProxy {
+		handler.Handle("/", download(proxy))
+	}
+	handler.Handle("/healthz", &healthCheck{dir: opts.cacheDir, minFree: uint64(opts.minFreeSpace)})
+	stats := newServerStats()
+	stats.caches = caches
+	stats.filesystems = flusher.filesystems
+	if opts.adminToken != "" {
+		handler.Handle("/admin/stats", requireToken(opts.adminToken, stats))
+		handler.Handle("/admin/flush-cache", requireToken(opts.adminToken, flusher))
+		handler.Handle("/admin/reset-traffic", requireToken(opts.adminToken, trafficReset{stats}))
+	}
+	var root http.Handler = handler
+	if len(opts.blockUserAgents) > 0 {
+		patterns, err := parseUserAgentPatterns(opts.blockUserAgents)
+		if err != nil {
+			return nil, err
+		}
+		root = blockUserAgents(patterns, root)
+	}
+	methods := []string{http.MethodGet, http.MethodHead}
+	if len(opts.allowedMethods) > 0 {
+		methods = []string{}
+		for _, method := range opts.allowedMethods {
+			methods = append(methods, strings.ToUpper(method))
+		}
+	}
+	root = allowMethods(methods, root)
+	if len(opts.errorPages) > 0 {
+		pages, err := loadErrorPages(opts.errorPages)
+		if err != nil {
+			return nil, err
+		}
+		root = pages.middleware(root)
+	}
+	if opts.otelEndpoint != "" {
+		tracer, err := newTracer(opts.otelEndpoint, opts.otelSampleRatio)
+		if err != nil {
+			return nil, err
+		}
+		root = tracer.middleware(root)
+	}
+	if opts.accessLog != "" {
+		accessLog, err := newAccessLog(opts.accessLog, opts.logErrorsOnly, opts.logExcludePaths)
+		if err != nil {
+			return nil, err
+		}
+		if opts.geoIPDB != "" {
+			accessLog.geoIP = true
+			accessLog.geoDB, err = openGeoIPDB(opts.geoIPDB)
+			if err != nil {
+				warnf("GeoIP database unavailable, the countries are not logged: %v", err)
+			}
+		}
+		root = accessLog.middleware(root)
+	}
+	if opts.slowRequest > 0 {
+		root = logSlowRequests(opts.slowRequest, root)
+	}
+	if opts.versionHeader {
+		root = versionHeader(root)
+	}
+	if len(opts.cacheControl) > 0 {
+		rules, err := parseCacheControlRules(opts.cacheControl)
+		if err != nil {
+			return nil, err
+		}
+		root = cacheControl(rules, root)
+	}
+	if opts.dumpRequests {
+		warnf("The requests are dumped, which makes the log verbose and should only be used for debugging")
+		root = dumpRequests(root)
+	}
+	root = stats.middleware(root)
+	if opts.drainPeriod > 0 {
+		root = &drainer{next: root, retryAfter: opts.drainRetryAfter}
+	}
+	server := &http.Server{
+		Addr:              opts.listen,
+		Handler:           root,
+		ConnState:         stats.connState,
+		ConnContext:       withConn,
+		WriteTimeout:      opts.writeTimeout,
+		IdleTimeout:       opts.idleTimeout,
+		ReadHeaderTimeout: opts.headerTimeout,
+	}
+	if opts.tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(opts.tlsCert, opts.tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		server.TLSConfig, err = newTLSConfig(opts)
+		if err != nil {
+			return nil, err
+		}
+		server.TLSConfig.Certificates = []tls.Certificate{cert}
+	}
+	onShutdown(server, caches.saveIndexes)
+	return server, nil
+}
+
+// scanDir reads a directory tree of a source so that its metadata is cached
+// by the underlying storage.
+func scanDir(ctxt context.Context, source http.FileSystem, name string) error {
+	dir, err := source.Open(name)
+	if err != nil {
+		return err
+	}
+	files, err := dir.Readdir(0)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	for _, info := range files {
+		if ctxt.Err() != nil {
+			return ctxt.Err()
+		}
+		if info.IsDir() {
+			if err := scanDir(ctxt, source, path.Join(name, info.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// warmup scans the configured directories before the server starts, giving
+// up after the warmup duration so that startup never hangs.
+func warmup(opts *serverOptions) error {
+	if opts.warmup <= 0 {
+		return nil
+	}
+	ctxt, cancel := context.WithTimeout(context.Background(), opts.warmup)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		var result error
+		locations := append(append(append([]string{}, opts.frontend...), opts.system...), opts.rom...)
+		for _, location := range locations {
+			if location == "" || location == upstreamLocation {
+				continue
+			}
+			source, err := newSource(location, opts.strictIndex, nil)
+			if err == nil {
+				err = scanDir(ctxt, source, "/")
+			}
+			if err != nil && result == nil {
+				result = fmt.Errorf("%s: %w", location, err)
+			}
+		}
+		done <- result
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctxt.Done():
+		return ctxt.Err()
+	}
 }
 
 func (cmd *serveCommand) Name() string {
@@ -230,11 +1385,52 @@ func (cmd *serveCommand) Run(args []string) error {
 		cmd.cli.Usage()
 		os.Exit(1)
 	}
-	server := newServer(cmd.listen, cmd.frontend, cmd.system, cmd.rom)
-	fmt.Println("Listening on", cmd.listen)
-	err := server.ListenAndServe()
-	if err == http.ErrServerClosed {
-		return nil
+	server, err := newServer(&cmd.options)
+	if err != nil {
+		return err
+	}
+	if cmd.options.effectiveConfig != "" {
+		if err := writeEffectiveConfig(cmd.cli, cmd.options.effectiveConfig); err != nil {
+			warnf("Could not write the effective configuration: %v", err)
+		}
+	}
+	if err := warmup(&cmd.options); err != nil {
+		warnf("Warmup incomplete: %v", err)
+	}
+	listeners, err := listen(&cmd.options)
+	if err != nil {
+		return err
+	}
+	for _, listener := range listeners {
+		infof("Listening on %s", listener.Addr())
+	}
+	var ad *advertiser
+	if cmd.options.advertise {
+		ad, err = advertise(listeners)
+		if err != nil {
+			warnf("Advertisement failed: %v", err)
+		} else {
+			defer ad.Close()
+		}
+	}
+	if cmd.options.checkUpdate {
+		go reportUpdate()
+	}
+	restarted := watchRestart(server, listeners, cmd.options.shutdownTimeout)
+	if cmd.options.reloadListen {
+		watchReload(listeners, args)
+	}
+	stopped := watchShutdown(server, cmd.options.drainPeriod, cmd.options.shutdownTimeout)
+	notifyReady()
+	err = serve(server, listeners, &cmd.options)
+	if err == nil {
+		select {
+		case <-restarted:
+		case <-stopped:
+			if ad != nil {
+				ad.withdraw()
+			}
+		}
 	}
 	return err
 }
@@ -0,0 +1,321 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// upstreamLocation is the location of the upstream server in a chain of
+// sources.
+const upstreamLocation string = "upstream"
+
+// isRemoteLocation tells whether a source location is an URL rather than a
+// local directory.
+func isRemoteLocation(location string) bool {
+	return strings.HasPrefix(location, "http://") ||
+		strings.HasPrefix(location, "https://") ||
+		strings.HasPrefix(location, "s3://")
+}
+
+// Modes of a route.
+const (
+	routeAuto     string = "auto"
+	routeLocal    string = "local"
+	routeProxy    string = "proxy"
+	routeFallback string = "fallback"
+	routeDisabled string = "disabled"
+)
+
+// routeLocations returns the locations of a route according to its mode: the
+// upstream location is removed from the local routes, and added to the
+// fallback ones. A local route requires a local or remote location.
+func routeLocations(locations []string, mode string) ([]string, error) {
+	switch mode {
+	case routeLocal:
+		result := []string{}
+		for _, location := range locations {
+			if location != "" && location != upstreamLocation {
+				result = append(result, location)
+			}
+		}
+		if len(result) == 0 {
+			return nil, fmt.Errorf("The %s mode requires a location", routeLocal)
+		}
+		return result, nil
+	case routeFallback:
+		if len(locations) == 0 || locations[len(locations)-1] != upstreamLocation {
+			return append(append([]string{}, locations...), upstreamLocation), nil
+		}
+	}
+	return locations, nil
+}
+
+// localPath returns the absolute path of a local location, with its symbolic
+// links resolved when possible.
+func localPath(location string) string {
+	result, err := filepath.Abs(location)
+	if err != nil {
+		return filepath.Clean(location)
+	}
+	if resolved, err := filepath.EvalSymlinks(result); err == nil {
+		result = resolved
+	}
+	return result
+}
+
+// isInside tells whether name is a descendant of the dir directory.
+func isInside(name, dir string) bool {
+	rel, err := filepath.Rel(dir, name)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// overlappingLocations returns a description of each pair of local locations
+// of different routes which are identical or nested.
+func overlappingLocations(opts *serverOptions) []string {
+	type local struct {
+		route string
+		path  string
+	}
+	locals := []local{}
+	routes := []struct {
+		name      string
+		locations []string
+	}{{"frontend", opts.frontend}, {"system", opts.system}, {"rom", opts.rom}}
+	for _, route := range routes {
+		for _, location := range route.locations {
+			if location != "" && location != upstreamLocation && !isRemoteLocation(location) && !isCASLocation(location) {
+				locals = append(locals, local{route.name, localPath(location)})
+			}
+		}
+	}
+	result := []string{}
+	for i, a := range locals {
+		for _, b := range locals[i+1:] {
+			switch {
+			case a.route == b.route:
+			case a.path == b.path:
+				result = append(result, fmt.Sprintf("The %s and %s locations are both %s", a.route, b.route, a.path))
+			case isInside(b.path, a.path):
+				result = append(result, fmt.Sprintf("The %s location %s is inside the %s location %s", b.route, b.path, a.route, a.path))
+			case isInside(a.path, b.path):
+				result = append(result, fmt.Sprintf("The %s location %s is inside the %s location %s", a.route, a.path, b.route, b.path))
+			}
+		}
+	}
+	return result
+}
+
+// newSource returns the file system serving the provided location, which is
+// either a local directory, a content-addressed store or a remote source. With
+// strict, the listings of a local directory fail on its unreadable entries,
+// which are skipped with a warning otherwise. The symbolic links of a local
+// directory are resolved with links, which may be nil.
+func newSource(location string, strict bool, links *symlinkCache) (http.FileSystem, error) {
+	if isRemoteLocation(location) {
+		return newRemoteSource(location)
+	}
+	if isCASLocation(location) {
+		return newCASSource(location)
+	}
+	return localDir{http.Dir(location), strict, links}, nil
+}
+
+// newChainSource returns the file system serving the provided locations by
+// priority order. The upstream location, which must be the last one, is not
+// part of the file system: the returned flag tells whether the requests not
+// served by the file system must be forwarded to the upstream server. The
+// file system is nil when there is no location other than upstream.
+func newChainSource(locations []string, strict bool, links *symlinkCache) (http.FileSystem, bool, error) {
+	upstream := false
+	chain := chainSource{}
+	for i, location := range locations {
+		if location == "" {
+			continue
+		}
+		if location == upstreamLocation {
+			if i != len(locations)-1 {
+				return nil, false, fmt.Errorf("The %s location must be the last one", upstreamLocation)
+			}
+			upstream = true
+			continue
+		}
+		source, err := newSource(location, strict, links)
+		if err != nil {
+			return nil, false, err
+		}
+		chain = append(chain, source)
+	}
+	switch len(chain) {
+	case 0:
+		return nil, true, nil
+	case 1:
+		return chain[0], upstream, nil
+	}
+	return chain, upstream, nil
+}
+
+// localDir is a local directory whose listings follow symbolic links.
+type localDir struct {
+	http.Dir
+	strict bool
+	links  *symlinkCache
+}
+
+func (d localDir) Open(name string) (http.File, error) {
+	file, err := d.Dir.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &localFile{File: file, path: filepath.Join(string(d.Dir), filepath.FromSlash(path.Clean("/"+name))), strict: d.strict, links: d.links}, nil
+}
+
+// localFile is a file of a local directory.
+type localFile struct {
+	http.File
+	path   string
+	strict bool
+	links  *symlinkCache
+}
+
+// Readdir resolves the symbolic links. Unless strict is set, the entries which
+// cannot be read, such as dangling links, are skipped with a warning rather
+// than failing the whole listing.
+func (f *localFile) Readdir(count int) ([]fs.FileInfo, error) {
+	files, err := f.File.Readdir(count)
+	if err != nil && err != io.EOF && !f.strict && len(files) > 0 {
+		// The entries which could be read are listed
+		warnf("Listing %s partially: %v", f.path, err)
+		err = nil
+	}
+	resolved, statErrs := f.links.resolve(f.path, files)
+	result := files[:0]
+	for i, info := range files {
+		if info.Mode().Type() == fs.ModeSymlink {
+			if statErr := statErrs[i]; statErr != nil {
+				if f.strict {
+					// Not reported as a missing directory
+					return nil, fmt.Errorf("Unreadable entry: %v", statErr)
+				}
+				warnf("Skipping %s from the listing: %v", filepath.Join(f.path, info.Name()), statErr)
+				continue
+			}
+			info = resolved[i]
+		}
+		result = append(result, info)
+	}
+	return result, err
+}
+
+// chainSource serves the files of the first source providing them. The
+// directories found in several sources are merged.
+type chainSource []http.FileSystem
+
+func (chain chainSource) Open(name string) (http.File, error) {
+	dirs := []http.File{}
+	var firstErr error
+	for _, source := range chain {
+		file, err := source.Open(name)
+		if err != nil {
+			if firstErr == nil && !errors.Is(err, fs.ErrNotExist) {
+				firstErr = err
+			}
+			continue
+		}
+		info, err := file.Stat()
+		if err == nil && !info.IsDir() && len(dirs) == 0 {
+			return file, nil
+		}
+		if err != nil || !info.IsDir() {
+			file.Close()
+			continue
+		}
+		dirs = append(dirs, file)
+	}
+	switch len(dirs) {
+	case 0:
+		if firstErr != nil {
+			return nil, firstErr
+		}
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case 1:
+		return dirs[0], nil
+	}
+	return &mergedDir{File: dirs[0], dirs: dirs}, nil
+}
+
+// mergedDir is a directory found in several sources of a chain. Its entries
+// are the union of the ones of each source, the first source taking
+// precedence.
+type mergedDir struct {
+	http.File
+	dirs    []http.File
+	entries []fs.FileInfo
+	read    bool
+}
+
+func (d *mergedDir) Close() error {
+	var result error
+	for _, dir := range d.dirs {
+		if err := dir.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+func (d *mergedDir) Readdir(count int) ([]fs.FileInfo, error) {
+	if !d.read {
+		d.read = true
+		found := map[string]bool{}
+		for _, dir := range d.dirs {
+			files, err := dir.Readdir(0)
+			if err != nil {
+				return nil, err
+			}
+			for _, info := range files {
+				if !found[info.Name()] {
+					found[info.Name()] = true
+					d.entries = append(d.entries, info)
+				}
+			}
+		}
+	}
+	n := len(d.entries)
+	if count > 0 {
+		if n == 0 {
+			return nil, io.EOF
+		}
+		if count < n {
+			n = count
+		}
+	}
+	result := d.entries[:n]
+	d.entries = d.entries[n:]
+	return result, nil
+}
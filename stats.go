@@ -0,0 +1,229 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// serverStats holds the counters of a running server.
+type serverStats struct {
+	start             time.Time
+	requests          atomic.Int64
+	bytesServed       atomic.Int64
+	connections       atomic.Int64
+	activeConnections atomic.Int64
+	// routes counts the requests and the bytes served by route root, the
+	// other requests being counted with the empty root, since routesSince,
+	// in Unix nanoseconds.
+	routes      map[string]*routeTraffic
+	routesSince atomic.Int64
+	// caches and the listing caches of filesystems are reported along with
+	// the counters.
+	caches      cacheSet
+	filesystems []*fileSystem
+}
+
+// trafficRoots are the roots of the routes whose traffic is counted.
+var trafficRoots = []string{"/frontend/", "/system/", "/cores/", ""}
+
+// routeTraffic holds the traffic counters of a route.
+type routeTraffic struct {
+	requests    atomic.Int64
+	bytesServed atomic.Int64
+}
+
+// routeStats are the traffic counters of a route. Route is "other" for the
+// requests outside the routes.
+type routeStats struct {
+	Route       string `json:"route"`
+	Requests    int64  `json:"requests"`
+	BytesServed int64  `json:"bytes_served"`
+}
+
+// cacheStats are the counters of a cache.
+type cacheStats struct {
+	Name      string `json:"name"`
+	Hits      int64  `json:"hits"`
+	Misses    int64  `json:"misses"`
+	Evictions int64  `json:"evictions"`
+	Size      int64  `json:"size"`
+}
+
+// statsReport is the JSON document served by the stats endpoint.
+type statsReport struct {
+	Version           string       `json:"version"`
+	Uptime            float64      `json:"uptime"`
+	Requests          int64        `json:"requests"`
+	BytesServed       int64        `json:"bytes_served"`
+	Connections       int64        `json:"connections"`
+	ActiveConnections int64        `json:"active_connections"`
+	Caches            []cacheStats `json:"caches,omitempty"`
+	Routes            []routeStats `json:"routes,omitempty"`
+	RoutesSince       time.Time    `json:"routes_since"`
+}
+
+func newServerStats() *serverStats {
+	stats := &serverStats{start: time.Now(), routes: map[string]*routeTraffic{}}
+	for _, root := range trafficRoots {
+		stats.routes[root] = &routeTraffic{}
+	}
+	stats.routesSince.Store(stats.start.UnixNano())
+	return stats
+}
+
+// route returns the traffic counters of the route of a URL path.
+func (stats *serverStats) route(urlPath string) *routeTraffic {
+	for _, root := range trafficRoots {
+		if strings.HasPrefix(urlPath, root) {
+			return stats.routes[root]
+		}
+	}
+	return stats.routes[""]
+}
+
+// middleware counts the requests and the bytes served by next.
+func (stats *serverStats) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats.requests.Add(1)
+		traffic := stats.route(r.URL.Path)
+		traffic.requests.Add(1)
+		rec := newResponseRecorder(w)
+		next.ServeHTTP(rec, r)
+		stats.bytesServed.Add(rec.bytes)
+		traffic.bytesServed.Add(rec.bytes)
+	})
+}
+
+// routeReport returns the traffic counters of the routes, which are reset
+// when reset is true.
+func (stats *serverStats) routeReport(reset bool) ([]routeStats, time.Time) {
+	since := time.Unix(0, stats.routesSince.Load())
+	if reset {
+		since = time.Unix(0, stats.routesSince.Swap(time.Now().UnixNano()))
+	}
+	result := []routeStats{}
+	for _, root := range trafficRoots {
+		traffic := stats.routes[root]
+		counters := routeStats{Route: root}
+		if reset {
+			counters.Requests, counters.BytesServed = traffic.requests.Swap(0), traffic.bytesServed.Swap(0)
+		} else {
+			counters.Requests, counters.BytesServed = traffic.requests.Load(), traffic.bytesServed.Load()
+		}
+		if root == "" {
+			counters.Route = "other"
+		}
+		result = append(result, counters)
+	}
+	return result, since
+}
+
+// connState counts the connections, to be used as http.Server.ConnState.
+func (stats *serverStats) connState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		stats.connections.Add(1)
+		stats.activeConnections.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		stats.activeConnections.Add(-1)
+	}
+}
+
+func (stats *serverStats) report() statsReport {
+	result := statsReport{
+		Version:           version,
+		Uptime:            time.Since(stats.start).Seconds(),
+		Requests:          stats.requests.Load(),
+		BytesServed:       stats.bytesServed.Load(),
+		Connections:       stats.connections.Load(),
+		ActiveConnections: stats.activeConnections.Load(),
+	}
+	for root, cache := range stats.caches {
+		result.Caches = append(result.Caches, cache.stats(strings.TrimSpace("proxy "+root)))
+	}
+	sort.Slice(result.Caches, func(i, j int) bool {
+		return result.Caches[i].Name < result.Caches[j].Name
+	})
+	for _, filesystem := range stats.filesystems {
+		result.Caches = append(result.Caches, filesystem.listingStats())
+	}
+	result.Routes, result.RoutesSince = stats.routeReport(false)
+	return result
+}
+
+// trafficReport is the JSON document served by the traffic reset endpoint:
+// the counters of the routes before they are reset.
+type trafficReport struct {
+	Routes []routeStats `json:"routes"`
+	Since  time.Time    `json:"since"`
+}
+
+// trafficReset resets the traffic counters of the routes.
+type trafficReset struct {
+	stats *serverStats
+}
+
+func (reset trafficReset) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	report := trafficReport{}
+	report.Routes, report.Since = reset.stats.routeReport(true)
+	infof("Reset the traffic counters of the routes")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func (stats *serverStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats.report())
+}
+
+// fetchStats queries the stats endpoint of a running server, giving up after
+// timeout.
+func fetchStats(server, token string, timeout time.Duration) (*statsReport, error) {
+	client := &http.Client{Timeout: timeout}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(server, "/")+"/admin/stats", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+	result := &statsReport{}
+	return result, json.NewDecoder(resp.Body).Decode(result)
+}
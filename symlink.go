@@ -0,0 +1,121 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// symlinkTarget is the resolved target of a symbolic link.
+type symlinkTarget struct {
+	// linkModTime is the modification time of the link itself, which changes
+	// when the link is replaced.
+	linkModTime time.Time
+	info        fs.FileInfo
+}
+
+// symlinkCache keeps the resolved targets of the symbolic links of the local
+// directories, so that the listings generated again do not resolve them each
+// time. An entry is resolved again when the modification time of its link
+// changes. At most maxEntries links are kept, and at most concurrency links
+// of a listing are resolved at the same time.
+type symlinkCache struct {
+	maxEntries int
+	slots      chan struct{}
+	mutex      sync.Mutex
+	entries    map[string]symlinkTarget
+}
+
+func newSymlinkCache(maxEntries, concurrency int) *symlinkCache {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &symlinkCache{maxEntries: maxEntries, slots: make(chan struct{}, concurrency), entries: map[string]symlinkTarget{}}
+}
+
+// lookup returns the cached target of the link stored at name, or nil if it
+// is missing or outdated.
+func (cache *symlinkCache) lookup(name string, link fs.FileInfo) fs.FileInfo {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	target, ok := cache.entries[name]
+	if !ok || !target.linkModTime.Equal(link.ModTime()) {
+		return nil
+	}
+	return target.info
+}
+
+// put stores the target of the link stored at name, evicting an arbitrary
+// entry when the cache is full. The targets which cannot be resolved are not
+// stored, so that they are resolved again once they are created.
+func (cache *symlinkCache) put(name string, link, info fs.FileInfo) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if info == nil {
+		delete(cache.entries, name)
+		return
+	}
+	if _, ok := cache.entries[name]; !ok && len(cache.entries) >= cache.maxEntries {
+		for evicted := range cache.entries {
+			delete(cache.entries, evicted)
+			break
+		}
+	}
+	cache.entries[name] = symlinkTarget{link.ModTime(), info}
+}
+
+// resolve returns the information of the targets of the symbolic links of
+// files, entries of dir, and the errors of the links which cannot be resolved,
+// at the same indexes. The other entries are nil. Without a cache, the links
+// are resolved one after the other.
+func (cache *symlinkCache) resolve(dir string, files []fs.FileInfo) ([]fs.FileInfo, []error) {
+	resolved := make([]fs.FileInfo, len(files))
+	errs := make([]error, len(files))
+	wg := sync.WaitGroup{}
+	for i, info := range files {
+		if info.Mode().Type() != fs.ModeSymlink {
+			continue
+		}
+		name := filepath.Join(dir, info.Name())
+		if cache == nil {
+			resolved[i], errs[i] = os.Stat(name)
+			continue
+		}
+		if target := cache.lookup(name, info); target != nil {
+			resolved[i] = target
+			continue
+		}
+		cache.slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, name string, link fs.FileInfo) {
+			defer wg.Done()
+			resolved[i], errs[i] = os.Stat(name)
+			<-cache.slots
+			cache.put(name, link, resolved[i])
+		}(i, name, info)
+	}
+	wg.Wait()
+	return resolved, errs
+}
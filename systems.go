@@ -0,0 +1,64 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const systemsJSONName string = ".systems.json"
+
+// systemEntry describes a subdirectory of the ROM route in .systems.json.
+type systemEntry struct {
+	Name  string `json:"name"`
+	Files int    `json:"files"`
+}
+
+// systemsJSON lists the subdirectories of the .index-dirs file with the number
+// of files of their .index file.
+func (filesystem *fileSystem) systemsJSON() (http.File, error) {
+	dirs, err := filesystem.indexDirs()
+	if err != nil {
+		return nil, err
+	}
+	entries := []systemEntry{}
+	for _, dir := range dirs {
+		files, err := filesystem.readDir(path.Join("/", dir))
+		if err != nil {
+			return nil, err
+		}
+		count := 0
+		for _, info := range files {
+			if info.Mode().IsRegular() {
+				count++
+			}
+		}
+		entries = append(entries, systemEntry{Name: dir, Files: count})
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+	return inMemoryFile{strings.NewReader(string(data)), systemsJSONName}, nil
+}
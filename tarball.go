@@ -0,0 +1,344 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// tarballMaxDepth limits the depth of the directories added to a tarball, as
+// a symbolic link may point to a parent directory.
+const tarballMaxDepth int = 16
+
+// tarballFlushSize is the size of the file contents added to a tarball after
+// which the response is flushed.
+const tarballFlushSize int64 = 1024 * 1024
+
+// tarballPath returns the URL path of the tarball of a route, such as
+// /frontend.tar.gz for /frontend/.
+func tarballPath(root string) string {
+	return strings.TrimSuffix(root, "/") + ".tar.gz"
+}
+
+// storedBlockSize is the maximum size of a stored deflate block.
+const storedBlockSize = 65535
+
+// tarballCompressor compresses a tarball.
+type tarballCompressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// tarballWriter writes a compressed tarball to a response.
+type tarballWriter struct {
+	*tar.Writer
+	gz      tarballCompressor
+	w       http.ResponseWriter
+	pending int64
+}
+
+// flush sends the data written so far to the client, once the size of the
+// files added since the previous flush reaches tarballFlushSize, so that the
+// client sees the download progress.
+func (tw *tarballWriter) flush(size int64) error {
+	tw.pending += size
+	if tw.pending < tarballFlushSize {
+		return nil
+	}
+	tw.pending = 0
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if err := tw.gz.Flush(); err != nil {
+		return err
+	}
+	if flusher, ok := tw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// storedGzipWriter writes a gzip stream made of stored deflate blocks of
+// storedBlockSize bytes, without compression, so that its size is known from
+// the size of the data.
+type storedGzipWriter struct {
+	w     io.Writer
+	block []byte
+	crc   uint32
+	size  uint32
+}
+
+// newStoredGzipWriter writes the gzip header to w.
+func newStoredGzipWriter(w io.Writer) (*storedGzipWriter, error) {
+	_, err := w.Write([]byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255})
+	return &storedGzipWriter{w: w, block: make([]byte, 0, storedBlockSize)}, err
+}
+
+// storedGzipSize returns the size of the stored gzip stream of size bytes: the
+// header, a block header per started block, an empty final block when the last
+// one is full, and the trailer.
+func storedGzipSize(size int64) int64 {
+	return 10 + size + 5*(size/storedBlockSize+1) + 8
+}
+
+// writeBlock writes the pending block, the last one when final is set.
+func (sw *storedGzipWriter) writeBlock(final bool) error {
+	header := []byte{0, byte(len(sw.block)), byte(len(sw.block) >> 8), 0, 0}
+	if final {
+		header[0] = 1
+	}
+	header[3], header[4] = ^header[1], ^header[2]
+	if _, err := sw.w.Write(header); err != nil {
+		return err
+	}
+	_, err := sw.w.Write(sw.block)
+	sw.block = sw.block[:0]
+	return err
+}
+
+func (sw *storedGzipWriter) Write(p []byte) (int, error) {
+	sw.crc = crc32.Update(sw.crc, crc32.IEEETable, p)
+	sw.size += uint32(len(p))
+	written := 0
+	for len(p) > 0 {
+		n := copy(sw.block[len(sw.block):storedBlockSize], p)
+		sw.block = sw.block[:len(sw.block)+n]
+		p = p[n:]
+		written += n
+		if len(sw.block) == storedBlockSize {
+			if err := sw.writeBlock(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Flush does nothing, the full blocks being already written.
+func (sw *storedGzipWriter) Flush() error {
+	return nil
+}
+
+// Close writes the final block and the trailer.
+func (sw *storedGzipWriter) Close() error {
+	if err := sw.writeBlock(true); err != nil {
+		return err
+	}
+	trailer := make([]byte, 8)
+	binary.LittleEndian.PutUint32(trailer, sw.crc)
+	binary.LittleEndian.PutUint32(trailer[4:], sw.size)
+	_, err := sw.w.Write(trailer)
+	return err
+}
+
+// tarballFile is a file of the source added to a tarball.
+type tarballFile struct {
+	name string
+	info fs.FileInfo
+}
+
+// header returns the tar header of the file.
+func (file tarballFile) header() *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     strings.TrimPrefix(file.name, "/"),
+		Size:     file.info.Size(),
+		Mode:     0644,
+		ModTime:  file.info.ModTime(),
+	}
+}
+
+// tarballSize returns the size of the uncompressed tarball of files.
+func tarballSize(files []tarballFile) (int64, error) {
+	size := int64(1024) // the end of archive blocks
+	for _, file := range files {
+		var counter countingWriter
+		if err := tar.NewWriter(&counter).WriteHeader(file.header()); err != nil {
+			return 0, err
+		}
+		size += counter.n + (file.info.Size()+511)/512*512
+	}
+	return size, nil
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter struct {
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
+
+// serveTarball streams a gzip compressed tar archive of all the files of the
+// source, built while it is sent. With TarballLength, the files are listed
+// first to send the Content-Length of the archive, which is then stored
+// without compression.
+func (filesystem *fileSystem) serveTarball(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var files []tarballFile
+	if filesystem.TarballLength {
+		err := filesystem.walkTarball(r.Context(), "/", 0, func(file tarballFile) error {
+			files = append(files, file)
+			return nil
+		})
+		var size int64
+		if err == nil {
+			size, err = tarballSize(files)
+		}
+		if err != nil {
+			if r.Context().Err() == nil {
+				errorf("Listing the files of tarball %s failed: %v", r.URL.Path, err)
+			}
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(storedGzipSize(size), 10))
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+path.Base(r.URL.Path)+"\"")
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, s := startSpan(r.Context(), "generate tarball", spanKindInternal)
+	s.setAttribute("url.path", r.URL.Path)
+	defer s.finish()
+	archive := &tarballWriter{w: w}
+	if filesystem.TarballLength {
+		gz, err := newStoredGzipWriter(w)
+		if err != nil {
+			debugf("Tarball %s abandoned by the client: %v", r.URL.Path, err)
+			return
+		}
+		archive.gz = gz
+	} else {
+		gz, err := gzip.NewWriterLevel(w, filesystem.ArchiveLevel)
+		if err != nil {
+			s.setError()
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		archive.gz = gz
+	}
+	archive.Writer = tar.NewWriter(archive.gz)
+	var err error
+	if files != nil {
+		for _, file := range files {
+			if err = r.Context().Err(); err != nil {
+				break
+			}
+			if err = filesystem.addToTarball(archive, file); err != nil {
+				break
+			}
+		}
+	} else {
+		err = filesystem.walkTarball(r.Context(), "/", 0, func(file tarballFile) error {
+			return filesystem.addToTarball(archive, file)
+		})
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err == nil {
+		err = archive.gz.Close()
+	}
+	if err != nil && r.Context().Err() != nil {
+		// The write errors follow the disconnection of the client
+		debugf("Tarball %s abandoned by the client: %v", r.URL.Path, err)
+	} else if err != nil {
+		// The status is already sent: the client gets a truncated archive.
+		s.setError()
+		warnf("Tarball %s interrupted: %v", r.URL.Path, err)
+	}
+}
+
+// walkTarball calls add with the regular files of a directory of the source,
+// sorted by name. It stops reading the directories as soon as ctxt is
+// canceled, when the client goes away.
+func (filesystem *fileSystem) walkTarball(ctxt context.Context, dir string, depth int, add func(tarballFile) error) error {
+	if depth > tarballMaxDepth {
+		return fmt.Errorf("Directory %s is too deep", dir)
+	}
+	if err := ctxt.Err(); err != nil {
+		return err
+	}
+	files, err := filesystem.readDir(dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+	for _, info := range files {
+		if err := ctxt.Err(); err != nil {
+			return err
+		}
+		name := path.Join(dir, info.Name())
+		if info.IsDir() {
+			if err := filesystem.walkTarball(ctxt, name, depth+1, add); err != nil {
+				return err
+			}
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if err := add(tarballFile{name, info}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addToTarball writes a file of the source in archive.
+func (filesystem *fileSystem) addToTarball(archive *tarballWriter, file tarballFile) error {
+	if err := archive.WriteHeader(file.header()); err != nil {
+		return err
+	}
+	f, err := filesystem.Source.Open(file.name)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(archive, f, file.info.Size())
+	f.Close()
+	if err == nil {
+		err = archive.flush(file.info.Size())
+	}
+	return err
+}
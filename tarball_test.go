@@ -0,0 +1,135 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestStoredGzipWriter(t *testing.T) {
+	for _, size := range []int{0, 1, storedBlockSize - 1, storedBlockSize, storedBlockSize + 1, 2 * storedBlockSize, 3*storedBlockSize + 7} {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(data)
+		out := &bytes.Buffer{}
+		gz, err := newStoredGzipWriter(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Uneven writes cross the block boundaries
+		for rest := data; len(rest) > 0; {
+			n := len(rest)
+			if n > 1000 {
+				n = 1000
+			}
+			if _, err := gz.Write(rest[:n]); err != nil {
+				t.Fatal(err)
+			}
+			rest = rest[n:]
+		}
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := int64(out.Len()), storedGzipSize(int64(size)); got != want {
+			t.Errorf("size %d: wrote %d bytes, storedGzipSize %d", size, got, want)
+		}
+		reader, err := gzip.NewReader(out)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		decoded, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Errorf("size %d: decoded data differs", size)
+		}
+	}
+}
+
+func TestTarballContentLength(t *testing.T) {
+	sizes := map[string]int{
+		"empty":                             0,
+		"one":                               1,
+		"block":                             512,
+		"a/stored-block":                    storedBlockSize,
+		"a/stored-block-plus-one":           storedBlockSize + 1,
+		"a/b/" + strings.Repeat("long", 40): 1000,
+		"a/b/non-ascii-é.txt":               3,
+	}
+	dir := t.TempDir()
+	for name, size := range sizes {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, bytes.Repeat([]byte{'x'}, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filesystem := &fileSystem{Source: http.Dir(dir), TarballLength: true, ArchiveLevel: gzip.DefaultCompression}
+	name := "/frontend.tar.gz"
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		w := httptest.NewRecorder()
+		filesystem.serveTarball(w, httptest.NewRequest(method, name, nil))
+		length, err := strconv.Atoi(w.Header().Get("Content-Length"))
+		if err != nil {
+			t.Fatalf("%s %s: invalid Content-Length: %v", method, name, err)
+		}
+		if method == http.MethodHead {
+			continue
+		}
+		if length != w.Body.Len() {
+			t.Errorf("%s %s: Content-Length %d, body of %d bytes", method, name, length, w.Body.Len())
+		}
+		archive, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries := tar.NewReader(archive)
+		count := 0
+		for {
+			header, err := entries.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if want, found := sizes[header.Name]; !found || int64(want) != header.Size {
+				t.Errorf("%s: unexpected entry %s of %d bytes", name, header.Name, header.Size)
+			}
+			count++
+		}
+		if count != len(sizes) {
+			t.Errorf("%s: %d entries, expected %d", name, count, len(sizes))
+		}
+	}
+}
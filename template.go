@@ -0,0 +1,79 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+)
+
+// listingEntry is an entry of the directory listing rendered by the index
+// template.
+type listingEntry struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// listingPage is the data provided to the index template.
+type listingPage struct {
+	Path    string
+	Entries []listingEntry
+}
+
+func loadIndexTemplate(name string) (*template.Template, error) {
+	return template.ParseFiles(name)
+}
+
+// serveTemplate renders the directory listing with the index template. It
+// returns false when the directory cannot be read, to let the file server
+// handle the request.
+func (filesystem *fileSystem) serveTemplate(w http.ResponseWriter, r *http.Request) bool {
+	files, err := filesystem.readDir(r.URL.Path[len(filesystem.Root)-1:])
+	if err != nil {
+		return false
+	}
+	page := listingPage{Path: r.URL.Path}
+	for _, info := range files {
+		page.Entries = append(page.Entries, listingEntry{
+			Name:    info.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			IsDir:   info.IsDir(),
+		})
+	}
+	sort.Slice(page.Entries, func(i, j int) bool {
+		return page.Entries[i].Name < page.Entries[j].Name
+	})
+	body := bytes.Buffer{}
+	if err := filesystem.Template.Execute(&body, page); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return true
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	http.ServeContent(w, r, path.Base(r.URL.Path), time.Time{}, bytes.NewReader(body.Bytes()))
+	return true
+}
@@ -0,0 +1,337 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Span kinds of the OTLP specification
+const (
+	spanKindInternal int = 1
+	spanKindServer   int = 2
+	spanKindClient   int = 3
+)
+
+const (
+	tracerBatchSize     int           = 512
+	tracerFlushInterval time.Duration = 5 * time.Second
+)
+
+// spanKey is the context key of the current span.
+type spanKey struct{}
+
+// span is an operation traced with the OpenTelemetry data model.
+type span struct {
+	tracer     *tracer
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	sampled    bool
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]any
+	failed     bool
+}
+
+// tracer exports the spans to an OTLP/HTTP collector, in JSON.
+type tracer struct {
+	endpoint string
+	ratio    float64
+	spans    chan *span
+	// client sends the spans, its timeout keeping a stalled collector from
+	// blocking the export forever.
+	client *http.Client
+}
+
+// parseOTelEndpoint returns the URL where the spans are sent, the traces path
+// being added to an endpoint without path.
+func parseOTelEndpoint(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("Invalid OpenTelemetry endpoint %s", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return u.String(), nil
+}
+
+func newTracer(endpoint string, ratio float64) (*tracer, error) {
+	endpoint, err := parseOTelEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	result := &tracer{endpoint: endpoint, ratio: ratio, spans: make(chan *span, tracerBatchSize*4), client: &http.Client{Timeout: tracerFlushInterval}}
+	go result.export()
+	return result, nil
+}
+
+// start begins a span, child of the span of the context if any.
+func (t *tracer) start(ctxt context.Context, name string, kind int) (context.Context, *span) {
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now(), attributes: map[string]any{}}
+	if parent, ok := ctxt.Value(spanKey{}).(*span); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+		s.sampled = parent.sampled
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = t.sample(s.traceID)
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctxt, spanKey{}, s), s
+}
+
+// sample decides whether a new trace is exported, according to the ratio.
+func (t *tracer) sample(traceID [16]byte) bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	return float64(binary.BigEndian.Uint64(traceID[8:])>>11) < t.ratio*float64(1<<53)
+}
+
+// startFromRequest begins the server span of a request, continuing the trace
+// of its traceparent header if any.
+func (t *tracer) startFromRequest(r *http.Request, name string) (context.Context, *span) {
+	ctxt := r.Context()
+	parts := strings.Split(r.Header.Get("Traceparent"), "-")
+	if len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		remote := &span{}
+		traceID, err1 := hex.DecodeString(parts[1])
+		spanID, err2 := hex.DecodeString(parts[2])
+		flags, err3 := strconv.ParseUint(parts[3], 16, 8)
+		if err1 == nil && err2 == nil && err3 == nil {
+			copy(remote.traceID[:], traceID)
+			copy(remote.spanID[:], spanID)
+			remote.sampled = flags&1 == 1
+			ctxt = context.WithValue(ctxt, spanKey{}, remote)
+		}
+	}
+	return t.start(ctxt, name, spanKindServer)
+}
+
+// traceparent returns the W3C trace context header value of the span.
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+// finish ends the span and queues it for export.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if !s.sampled {
+		return
+	}
+	select {
+	case s.tracer.spans <- s:
+	default:
+		// Queue full, the span is dropped
+	}
+}
+
+// startSpan begins a span if the context is traced. It returns a nil span
+// otherwise, whose methods do nothing.
+func startSpan(ctxt context.Context, name string, kind int) (context.Context, *span) {
+	parent, ok := ctxt.Value(spanKey{}).(*span)
+	if !ok || parent.tracer == nil {
+		return ctxt, nil
+	}
+	return parent.tracer.start(ctxt, name, kind)
+}
+
+func (s *span) setAttribute(key string, value any) {
+	if s != nil {
+		s.attributes[key] = value
+	}
+}
+
+func (s *span) setError() {
+	if s != nil {
+		s.failed = true
+	}
+}
+
+// middleware traces the requests handled by next.
+func (t *tracer) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctxt, s := t.startFromRequest(r, r.Method)
+		s.setAttribute("http.request.method", r.Method)
+		s.setAttribute("url.path", r.URL.Path)
+		s.setAttribute("user_agent.original", r.UserAgent())
+		rec := newResponseRecorder(w)
+		next.ServeHTTP(rec, r.WithContext(ctxt))
+		s.setAttribute("http.response.status_code", rec.status)
+		s.setAttribute("http.response.body.size", rec.bytes)
+		if rec.status >= 500 {
+			s.failed = true
+		}
+		s.finish()
+	})
+}
+
+// tracingTransport traces the requests sent to the upstream server.
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (tt *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctxt, s := startSpan(req.Context(), req.Method, spanKindClient)
+	if s == nil {
+		return tt.next.RoundTrip(req)
+	}
+	// A RoundTripper must not modify the request of the caller
+	req = req.Clone(ctxt)
+	req.Header.Set("Traceparent", s.traceparent())
+	s.setAttribute("http.request.method", req.Method)
+	s.setAttribute("url.full", req.URL.String())
+	resp, err := tt.next.RoundTrip(req)
+	if err != nil {
+		s.setError()
+	} else {
+		s.setAttribute("http.response.status_code", resp.StatusCode)
+		if resp.StatusCode >= 400 {
+			s.setError()
+		}
+	}
+	s.finish()
+	return resp, err
+}
+
+// export sends the queued spans by batches.
+func (t *tracer) export() {
+	ticker := time.NewTicker(tracerFlushInterval)
+	defer ticker.Stop()
+	batch := []*span{}
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < tracerBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.send(batch); err != nil {
+			errorf("OpenTelemetry export error: %v", err)
+		}
+		batch = []*span{}
+	}
+}
+
+func otlpValue(value any) map[string]any {
+	switch v := value.(type) {
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		return map[string]any{"doubleValue": v}
+	case bool:
+		return map[string]any{"boolValue": v}
+	default:
+		return map[string]any{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+func otlpAttributes(attributes map[string]any) []map[string]any {
+	result := []map[string]any{}
+	for key, value := range attributes {
+		result = append(result, map[string]any{"key": key, "value": otlpValue(value)})
+	}
+	return result
+}
+
+// send posts a batch of spans to the collector.
+func (t *tracer) send(batch []*span) error {
+	spans := []map[string]any{}
+	for _, s := range batch {
+		item := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attributes),
+		}
+		if s.parentID != [8]byte{} {
+			item["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.failed {
+			item["status"] = map[string]any{"code": 2}
+		}
+		spans = append(spans, item)
+	}
+	payload := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": otlpAttributes(map[string]any{
+				"service.name":    "retroarch-asset-server",
+				"service.version": version,
+			})},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "retroarch-asset-server", "version": version},
+				"spans": spans,
+			}},
+		}},
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+	return nil
+}
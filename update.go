@@ -0,0 +1,142 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// latestReleaseURL is the GitHub API endpoint of the latest release.
+const latestReleaseURL string = "https://api.github.com/repos/fplassier/retroarch-asset-server/releases/latest"
+
+// release is the description of a GitHub release.
+type release struct {
+	TagName string `json:"tag_name"`
+	HTMLURL string `json:"html_url"`
+}
+
+// latestRelease returns the latest published release.
+func latestRelease(timeout time.Duration) (*release, error) {
+	client := &http.Client{Timeout: timeout}
+	req, err := http.NewRequest(http.MethodGet, latestReleaseURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+	result := &release{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// isNewerVersion tells whether the candidate version, with an optional v
+// prefix, is greater than the current one. The versions are compared by their
+// dot separated numbers.
+func isNewerVersion(candidate, current string) bool {
+	a := strings.Split(strings.TrimPrefix(candidate, "v"), ".")
+	b := strings.Split(strings.TrimPrefix(current, "v"), ".")
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x, _ = strconv.Atoi(a[i])
+		}
+		if i < len(b) {
+			y, _ = strconv.Atoi(b[i])
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+// reportUpdate logs the latest release when it is newer than the running
+// version.
+func reportUpdate() {
+	latest, err := latestRelease(30 * time.Second)
+	if err != nil {
+		warnf("Update check failed: %v", err)
+		return
+	}
+	if isNewerVersion(latest.TagName, version) {
+		infof("Version %s is available at %s", strings.TrimPrefix(latest.TagName, "v"), latest.HTMLURL)
+	}
+}
+
+type checkUpdateCommand struct {
+	timeout time.Duration
+	cli     *flag.FlagSet
+}
+
+func newCheckUpdateCommand() *checkUpdateCommand {
+	result := &checkUpdateCommand{}
+	result.cli = flag.NewFlagSet(result.Name(), flag.ExitOnError)
+	result.cli.DurationVar(&result.timeout, "timeout", 10*time.Second, "maximum duration of the request")
+	return result
+}
+
+func (cmd *checkUpdateCommand) Name() string {
+	return "check-update"
+}
+
+func (cmd *checkUpdateCommand) Desc() string {
+	return "Check whether a newer version is released, without downloading it."
+}
+
+func (cmd *checkUpdateCommand) PrintUsage() {
+	cmd.cli.Usage()
+}
+
+func (cmd *checkUpdateCommand) Run(args []string) error {
+	cmd.cli.Parse(args)
+	if cmd.cli.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Unknown argument", cmd.cli.Arg(0))
+		cmd.cli.SetOutput(os.Stderr)
+		cmd.cli.Usage()
+		os.Exit(1)
+	}
+	latest, err := latestRelease(cmd.timeout)
+	if err != nil {
+		return err
+	}
+	if !isNewerVersion(latest.TagName, version) {
+		fmt.Println("Version", version, "is up to date")
+		return nil
+	}
+	fmt.Println("Version", strings.TrimPrefix(latest.TagName, "v"), "is available at", latest.HTMLURL)
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// userAgentRule serves the requests whose User-Agent header matches pattern
+// with handler, built from locations.
+type userAgentRule struct {
+	pattern   *regexp.Regexp
+	locations []string
+	handler   http.Handler
+}
+
+// parseUserAgentRules parses REGEXP=LOCATION rules, the locations of the same
+// expression being chained in the order of the rules, which are matched in the
+// order of their first occurrence.
+func parseUserAgentRules(values []string) ([]userAgentRule, error) {
+	result := []userAgentRule{}
+	indexes := map[string]int{}
+	for _, value := range values {
+		i := strings.LastIndex(value, "=")
+		if i <= 0 || i == len(value)-1 {
+			return nil, fmt.Errorf("Invalid user agent rule %s: expected REGEXP=LOCATION", value)
+		}
+		expr, location := value[:i], value[i+1:]
+		if index, found := indexes[expr]; found {
+			result[index].locations = append(result[index].locations, location)
+			continue
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid user agent rule %s: %w", value, err)
+		}
+		indexes[expr] = len(result)
+		result = append(result, userAgentRule{pattern: pattern, locations: []string{location}})
+	}
+	return result, nil
+}
+
+// routeUserAgents serves the requests with the handler of the first rule
+// matching their User-Agent header, and with next otherwise. The responses
+// vary by User-Agent for the shared caches.
+func routeUserAgents(rules []userAgentRule, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "User-Agent")
+		userAgent := r.UserAgent()
+		for _, rule := range rules {
+			if rule.pattern.MatchString(userAgent) {
+				rule.handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
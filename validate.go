@@ -0,0 +1,230 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+type validateIndexCommand struct {
+	options serverOptions
+	cli     *flag.FlagSet
+}
+
+func newValidateIndexCommand() *validateIndexCommand {
+	result := &validateIndexCommand{}
+	result.cli = flag.NewFlagSet(result.Name(), flag.ExitOnError)
+	result.options.registerFlags(result.cli)
+	return result
+}
+
+func (cmd *validateIndexCommand) Name() string {
+	return "validate-index"
+}
+
+func (cmd *validateIndexCommand) Desc() string {
+	return "Generate the index files of the configured directories and check their format."
+}
+
+func (cmd *validateIndexCommand) PrintUsage() {
+	cmd.cli.Usage()
+}
+
+// hasLocalLocation tells whether a route serves files from at least one
+// location, rather than only proxying the upstream server or being disabled by
+// its mode.
+func hasLocalLocation(locations []string, mode string) bool {
+	if mode == routeProxy || mode == routeDisabled {
+		return false
+	}
+	for _, location := range locations {
+		if location != "" && location != upstreamLocation {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch returns the body of a successful GET request handled by handler.
+func fetch(handler http.Handler, target string) ([]byte, error) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %d", rec.Code)
+	}
+	return rec.Body.Bytes(), nil
+}
+
+// validateListing checks the format of an index file, made of one name per
+// line with an optional checksum footer, and returns the number of entries.
+func validateListing(body []byte, sorted bool) (int, error) {
+	if len(body) == 0 {
+		return 0, nil
+	}
+	content := string(body)
+	if !strings.HasSuffix(content, "\n") {
+		return 0, fmt.Errorf("Missing final newline, the file may be truncated")
+	}
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	if footer := lines[len(lines)-1]; strings.HasPrefix(footer, indexFooterPrefix) {
+		lines = lines[:len(lines)-1]
+		var count int
+		var checksum uint32
+		if _, err := fmt.Sscanf(footer, indexFooterPrefix+"%d crc32=%x", &count, &checksum); err != nil {
+			return 0, fmt.Errorf("Invalid footer %q: %w", footer, err)
+		}
+		if count != len(lines) {
+			return 0, fmt.Errorf("Footer announces %d entries but %d are listed", count, len(lines))
+		}
+		listed := content[:len(content)-len(footer)-1]
+		if actual := crc32.ChecksumIEEE([]byte(listed)); actual != checksum {
+			return 0, fmt.Errorf("Footer checksum %08x does not match the content checksum %08x", checksum, actual)
+		}
+	}
+	names := map[string]bool{}
+	for i, name := range lines {
+		switch {
+		case name == "":
+			return 0, fmt.Errorf("Line %d: empty name", i+1)
+		case strings.TrimSpace(name) != name:
+			return 0, fmt.Errorf("Line %d: name %q has surrounding spaces", i+1, name)
+		case strings.Contains(name, "/"):
+			return 0, fmt.Errorf("Line %d: name %q contains a slash", i+1, name)
+		case names[name]:
+			return 0, fmt.Errorf("Line %d: duplicate name %q", i+1, name)
+		}
+		names[name] = true
+	}
+	if sorted && !sort.StringsAreSorted(lines) {
+		return 0, fmt.Errorf("Names are not sorted")
+	}
+	return len(lines), nil
+}
+
+// validateManifest checks that a core manifest is a valid JSON document and
+// returns the number of cores.
+func validateManifest(body []byte) (int, error) {
+	cores := []coreEntry{}
+	if err := json.Unmarshal(body, &cores); err != nil {
+		return 0, fmt.Errorf("Invalid JSON: %w", err)
+	}
+	for i, core := range cores {
+		if core.Name == "" || core.Path == "" {
+			return 0, fmt.Errorf("Core %d: missing name or path", i)
+		}
+	}
+	return len(cores), nil
+}
+
+// validateIndexJSON checks that an .index.json listing is a valid JSON page
+// listing the count files of the .index file of the same directory, and
+// returns the number of files.
+func validateIndexJSON(body []byte, count int) (int, error) {
+	page := indexJSONPage{}
+	if err := json.Unmarshal(body, &page); err != nil {
+		return 0, fmt.Errorf("Invalid JSON: %w", err)
+	}
+	if page.Total != count {
+		return 0, fmt.Errorf("Total %d does not match the %d entries of the .index file", page.Total, count)
+	}
+	if len(page.Entries) != page.Total {
+		return 0, fmt.Errorf("Total %d does not match the %d listed files", page.Total, len(page.Entries))
+	}
+	return page.Total, nil
+}
+
+// listingNames returns the names of a valid index file.
+func listingNames(body []byte) []string {
+	result := []string{}
+	for _, line := range strings.Split(string(body), "\n") {
+		if line != "" && !strings.HasPrefix(line, indexFooterPrefix) {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+func (cmd *validateIndexCommand) Run(args []string) error {
+	cmd.cli.Parse(args)
+	if cmd.cli.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Unknown argument", cmd.cli.Arg(0))
+		cmd.cli.SetOutput(os.Stderr)
+		cmd.cli.Usage()
+		os.Exit(1)
+	}
+	if !hasLocalLocation(cmd.options.system, cmd.options.systemMode) && !hasLocalLocation(cmd.options.rom, cmd.options.romMode) {
+		return fmt.Errorf("No indexed directory is configured, use the system or rom options")
+	}
+	server, err := newServer(&cmd.options)
+	if err != nil {
+		return err
+	}
+	invalid := 0
+	validate := func(target string, validator func([]byte) (int, error)) []byte {
+		body, err := fetch(server.Handler, target)
+		count := 0
+		if err == nil {
+			count, err = validator(body)
+		}
+		if err != nil {
+			invalid++
+			fmt.Printf("%s: %s\n", target, err)
+			return nil
+		}
+		fmt.Printf("%s: valid, %d entries\n", target, count)
+		return body
+	}
+	listing := func(body []byte) (int, error) { return validateListing(body, false) }
+	sortedListing := func(body []byte) (int, error) { return validateListing(body, true) }
+	// The .index.json file of a directory is checked against its valid .index file
+	indexes := func(dir string) {
+		if body := validate(dir+".index", listing); body != nil {
+			count := len(listingNames(body))
+			validate(dir+indexJSONName, func(body []byte) (int, error) { return validateIndexJSON(body, count) })
+		}
+	}
+
+	if hasLocalLocation(cmd.options.system, cmd.options.systemMode) {
+		indexes("/system/")
+	}
+	if hasLocalLocation(cmd.options.rom, cmd.options.romMode) {
+		indexes("/cores/")
+		validate("/cores/.manifest.json", validateManifest)
+		if body := validate("/cores/.index-dirs", sortedListing); body != nil {
+			for _, dir := range listingNames(body) {
+				indexes("/cores/" + url.PathEscape(dir) + "/")
+			}
+		}
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d invalid index files", invalid)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2024 Fabien Plassier
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type verifyCommand struct {
+	timeout  time.Duration
+	manifest string
+	cli      *flag.FlagSet
+}
+
+func newVerifyCommand() *verifyCommand {
+	result := &verifyCommand{}
+	result.cli = flag.NewFlagSet(result.Name(), flag.ExitOnError)
+	result.cli.Usage = func() {
+		fmt.Fprintf(result.cli.Output(), "Usage: %s %s [OPTIONS...] UPSTREAM_PATH DIR\n", os.Args[0], result.Name())
+		result.cli.PrintDefaults()
+	}
+	result.cli.DurationVar(&result.timeout, "timeout", time.Minute, "maximum duration of the download of the checksum list")
+	result.cli.StringVar(&result.manifest, "manifest", ".index-extended", "name of the checksum list in the upstream directory")
+	return result
+}
+
+func (cmd *verifyCommand) Name() string {
+	return "verify"
+}
+
+func (cmd *verifyCommand) Desc() string {
+	return "Check the local files of a directory against the checksums published by the upstream server."
+}
+
+func (cmd *verifyCommand) PrintUsage() {
+	cmd.cli.Usage()
+}
+
+// checksumEntry is a file of an upstream checksum list.
+type checksumEntry struct {
+	name  string
+	crc32 uint32
+}
+
+// parseChecksums reads a checksum list, made of one DATE CRC32 NAME line per
+// file.
+func parseChecksums(r io.Reader) ([]checksumEntry, error) {
+	result := []checksumEntry{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		fields := strings.SplitN(text, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Line %d: expected DATE CRC32 NAME", line)
+		}
+		checksum, err := strconv.ParseUint(fields[1], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: invalid checksum %q", line, fields[1])
+		}
+		result = append(result, checksumEntry{name: fields[2], crc32: uint32(checksum)})
+	}
+	return result, scanner.Err()
+}
+
+// downloadChecksums returns the entries of the checksum list of an upstream
+// directory.
+func (cmd *verifyCommand) downloadChecksums(dir string) ([]checksumEntry, error) {
+	base, err := parseUpstreamURL(retroarchHost)
+	if err != nil {
+		return nil, err
+	}
+	target := base.ResolveReference(&url.URL{Path: strings.Trim(dir, "/") + "/" + cmd.manifest})
+	client := &http.Client{Timeout: cmd.timeout}
+	resp, err := client.Get(target.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status %s", target, resp.Status)
+	}
+	return parseChecksums(resp.Body)
+}
+
+// fileChecksum returns the CRC32 checksum of the content of a file.
+func fileChecksum(name string) (uint32, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	hash := crc32.NewIEEE()
+	if _, err := io.Copy(hash, file); err != nil {
+		return 0, err
+	}
+	return hash.Sum32(), nil
+}
+
+func (cmd *verifyCommand) Run(args []string) error {
+	cmd.cli.Parse(args)
+	if cmd.cli.NArg() != 2 {
+		cmd.cli.SetOutput(os.Stderr)
+		cmd.cli.Usage()
+		os.Exit(1)
+	}
+	entries, err := cmd.downloadChecksums(cmd.cli.Arg(0))
+	if err != nil {
+		return err
+	}
+	dir := cmd.cli.Arg(1)
+	missing := 0
+	mismatches := 0
+	for _, entry := range entries {
+		checksum, err := fileChecksum(filepath.Join(dir, filepath.FromSlash(entry.name)))
+		switch {
+		case os.IsNotExist(err):
+			fmt.Printf("%s: missing\n", entry.name)
+			missing++
+		case err != nil:
+			fmt.Printf("%s: %s\n", entry.name, err)
+			mismatches++
+		case checksum != entry.crc32:
+			fmt.Printf("%s: checksum %08x does not match the upstream checksum %08x\n", entry.name, checksum, entry.crc32)
+			mismatches++
+		}
+	}
+	fmt.Printf("%d files checked, %d missing, %d corrupted\n", len(entries), missing, mismatches)
+	if missing > 0 || mismatches > 0 {
+		return fmt.Errorf("%d files do not match the upstream server", missing+mismatches)
+	}
+	return nil
+}